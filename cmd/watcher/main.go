@@ -10,16 +10,25 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net/http"
 	"os"
 	"strings"
-	"sync"
+	"time"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog"
 
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis"
+	"github.com/open-cluster-management/configmap-watcher/pkg/controller"
 	watcherController "github.com/open-cluster-management/configmap-watcher/pkg/controller/watcher"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
 func main() {
@@ -27,16 +36,50 @@ func main() {
 	defer klog.Flush()
 
 	var allowed map[string]struct{}
-	var allowedNamespaces string
+	var allowedNamespaces, compareLabels, compareAnnotations, workloadKinds string
+	var restrictNamespaces, dryRun, watchPolicies, recreatePods, recreateJobs, signalPods bool
+	var leaderElect bool
+	var workers, restartsPerMinute int
 	var gatherFreq, cleanFreq uint
-	var restrictNamespaces bool
+	var leaseName, leaseNamespace, metricsAddr, healthProbeAddr string
+	var hashKeySecret, hashKeyNamespace string
+	var leaseDuration, renewDeadline, retryPeriod, unhealthyAfter, shutdownGracePeriod, debounce time.Duration
 	flag.StringVar(&allowedNamespaces, "allowed-namespaces", "", "Space-separated namespaces. Only the deployments/daemonsets/statefulsets in these namespaces are allowed to use this controller to watch configmaps and restart themselves when those configmaps change.")
-	flag.UintVar(&gatherFreq, "gather-frequency", 20, "How frequently (in seconds) to gather configmaps from kubernetes deployments/daemonsets/statefulsets")
-	flag.UintVar(&cleanFreq, "clean-frequency", 100, "How frequently (in count) we want to clean up stale resources.")
+	flag.StringVar(&compareLabels, "compare-labels", "", "Space-separated label keys. A change to one of these labels on a watched configmap/secret restarts the workloads watching it, as a change to its data does.")
+	flag.StringVar(&compareAnnotations, "compare-annotations", "", "Space-separated annotation keys. A change to one of these annotations on a watched configmap/secret restarts the workloads watching it, as a change to its data does.")
 	flag.BoolVar(&restrictNamespaces, "restrict-namespaces", false, "If true, restricts which deployable is allowed to use this controller based on the allowed-namespaces flag.")
+	flag.BoolVar(&dryRun, "dry-run", false, "If true, restarts are only logged, and recorded as events and metrics, instead of performed.")
+	flag.DurationVar(&debounce, "debounce", 0, "Duration a workload's configmaps and secrets must go unchanged before it's restarted, so a burst of updates causes a single restart. Zero restarts right away. The watcher.ibm.com/debounce annotation overrides it per workload.")
+	flag.IntVar(&workers, "workers", 2, "Number of workload restarts performed at once.")
+	flag.IntVar(&restartsPerMinute, "restarts-per-minute", 60, "Cap on the workload restarts performed per minute, across every workload. Zero for no cap.")
+	flag.StringVar(&workloadKinds, "workload-kinds", "", "Space-separated kinds of workloads, beyond deployments/daemonsets/statefulsets/cronjobs/jobs/pods, that opt in and are restarted, as <Kind>.<version>.<group>[/<resource>][:<pod template path>] such as Rollout.v1alpha1.argoproj.io. The resource defaults to the lowercase plural of the kind, and the pod template path to spec.template.")
+	flag.BoolVar(&recreatePods, "recreate-pods", false, "If true, opted-in pods owned by nothing are evicted and created again by the watcher, which requires the right to create pods. Otherwise they fail to restart.")
+	flag.BoolVar(&recreateJobs, "recreate-jobs", false, "If true, opted-in jobs that are running are deleted and created again by the watcher with the new config hash, which requires the right to create and delete jobs. Otherwise they fail to restart.")
+	flag.BoolVar(&signalPods, "signal-pods", false, "If true, the pods of workloads with the signal strategy are sent their signal through pods/exec, which requires the right to create pods/exec. Otherwise those workloads fail to restart.")
+	flag.BoolVar(&watchPolicies, "watch-policies", true, "If true, the workloads WatchPolicies select watch the configmaps and secrets the policies name, along with those named in their annotations. Requires the WatchPolicy CRD.")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "If true, the replicas of this controller elect a leader with a Lease, and only the leader watches configmaps and restarts workloads.")
+	flag.StringVar(&leaseName, "lease-name", "configmap-watcher", "Name of the Lease used for leader election.")
+	flag.StringVar(&leaseNamespace, "lease-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the Lease used for leader election. Defaults to the POD_NAMESPACE environment variable.")
+	flag.DurationVar(&leaseDuration, "lease-duration", 15*time.Second, "Duration the other replicas wait before taking over the Lease from a leader that stopped renewing it.")
+	flag.DurationVar(&renewDeadline, "renew-deadline", 10*time.Second, "Duration the leader retries renewing the Lease before giving up leadership.")
+	flag.DurationVar(&retryPeriod, "retry-period", 2*time.Second, "Duration the replicas wait between attempts to acquire or renew the Lease.")
+	flag.StringVar(&hashKeySecret, "hash-key-secret", "configmap-watcher-hash-key", "Name of the Secret holding the key the config hashes are keyed with, created with a random key if it doesn't exist.")
+	flag.StringVar(&hashKeyNamespace, "hash-key-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the hash key Secret. Defaults to the POD_NAMESPACE environment variable. If empty, a random key is used for each run.")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the /metrics endpoint binds to. Empty disables it.")
+	flag.StringVar(&healthProbeAddr, "health-probe-addr", ":8081", "The address the /healthz and /readyz endpoints bind to. Empty disables them.")
+	flag.DurationVar(&unhealthyAfter, "unhealthy-after", 2*time.Minute, "Duration the event handlers may stall, or the API server be unreachable, before /healthz fails.")
+	flag.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", 30*time.Second, "Duration the watcher waits for the queued restarts to finish once it's terminated.")
+	// Kept so existing deployments passing them still start, the workloads are watched with informers instead
+	flag.UintVar(&gatherFreq, "gather-frequency", 0, "Deprecated: does nothing, the workloads are watched with informers.")
+	flag.UintVar(&cleanFreq, "clean-frequency", 0, "Deprecated: does nothing, unwatched configmaps and secrets are dropped as soon as nothing watches them.")
 	flag.Set("logtostderr", "true") /* #nosec G104 */
 
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "gather-frequency" || f.Name == "clean-frequency" {
+			klog.Warningf("The --%s flag is deprecated and does nothing", f.Name)
+		}
+	})
 
 	// Adding every allowed namespace into the map
 	allowed = make(map[string]struct{})
@@ -46,6 +89,16 @@ func main() {
 	}
 	klog.V(5).Infof("Allowed namespaces %v", allowed)
 
+	var kinds []watcherController.WorkloadKind
+	for _, value := range strings.Fields(workloadKinds) {
+		kind, err := watcherController.ParseWorkloadKind(value)
+		if err != nil {
+			klog.Error(err, "Unable to parse the workload-kinds flag")
+			os.Exit(1)
+		}
+		kinds = append(kinds, kind)
+	}
+
 	klog.Info("In main. Starting now")
 
 	klog.V(11).Info("Getting the kubeconfig...")
@@ -59,19 +112,160 @@ func main() {
 	klog.V(11).Info("Got kube config, getting client")
 	// Get kubernetes client based on config
 	var kubeClient kubernetes.Interface = kubernetes.NewForConfigOrDie(cfg)
-	watcher := watcherController.Init(kubeClient, allowed, cleanFreq, restrictNamespaces)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		klog.V(11).Info("Starting gather configmap")
-		for {
-			watcher.GatherConfigMaps(gatherFreq)
-			klog.V(11).Info("Back in for loop before another call gather configs")
+	// The hashes are keyed so the data of the secrets watched can't be guessed from them
+	var hashKey []byte
+	if hashKeyNamespace != "" {
+		hashKey, err = watcherController.LoadHashKey(kubeClient, hashKeyNamespace, hashKeySecret)
+		if err != nil {
+			klog.Error(err, "Unable to load the config hash key")
+			os.Exit(1)
+		}
+	} else {
+		klog.Warning("No namespace for the hash key secret, the config hashes change each time the watcher starts")
+	}
+	opts := watcherController.Options{
+		AllowedNamespaces:   allowed,
+		RestrictNamespaces:  restrictNamespaces,
+		ComparedLabels:      strings.Fields(compareLabels),
+		ComparedAnnotations: strings.Fields(compareAnnotations),
+		UnhealthyAfter:      unhealthyAfter,
+		ShutdownGracePeriod: shutdownGracePeriod,
+		DryRun:              dryRun,
+		Debounce:            debounce,
+		Workers:             workers,
+		RestartsPerMinute:   restartsPerMinute,
+		WorkloadKinds:       kinds,
+		DynamicClient:       dynamic.NewForConfigOrDie(cfg),
+		HashKey:             hashKey,
+		RecreatePods:        recreatePods,
+		RecreateJobs:        recreateJobs,
+	}
+	// The pods are only exec'd into when the watcher is allowed to
+	if signalPods {
+		opts.RestConfig = cfg
+	}
+	watcher := watcherController.Init(kubeClient, opts)
+	// The manager runs the controllers reconciling the WatchPolicies into the watcher
+	var mgr manager.Manager
+	if watchPolicies {
+		// The watcher serves the metrics, and does its own leader election
+		mgr, err = manager.New(cfg, manager.Options{MetricsBindAddress: "0"})
+		if err != nil {
+			klog.Error(err, "Unable to create the controller manager")
+			os.Exit(1)
 		}
-		klog.V(11).Info("Exited worker configmap watcher")
+		if err := apis.AddToScheme(mgr.GetScheme()); err != nil {
+			klog.Error(err, "Unable to add the WatchPolicy API to the scheme")
+			os.Exit(1)
+		}
+		if err := controller.AddToManager(mgr, watcher); err != nil {
+			klog.Error(err, "Unable to add the controllers to the manager")
+			os.Exit(1)
+		}
+	}
+	// Every replica serves metrics and health probes, whether or not it's the leader
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", watcherController.MetricsHandler())
+		go serve(metricsAddr, mux)
+	}
+	if healthProbeAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", watcherController.HealthHandler(watcher.Healthz))
+		mux.Handle("/readyz", watcherController.HealthHandler(watcher.Readyz))
+		go serve(healthProbeAddr, mux)
+	}
+
+	// SIGTERM or SIGINT stops the watcher once the restarts in flight have finished, a second one exits right away
+	ctx, cancel := context.WithCancel(context.Background())
+	stopCh := signals.SetupSignalHandler()
+	go func() {
+		<-stopCh
+		klog.Info("Received a termination signal, shutting down")
+		cancel()
 	}()
-	klog.V(11).Info("Outside the go functions")
-	wg.Wait()
-	klog.V(11).Info("After the wait function")
+
+	run := func() {
+		if mgr != nil {
+			// Without the policies the watcher still watches what the workloads' annotations name
+			go func() {
+				if err := mgr.Start(ctx.Done()); err != nil {
+					klog.Error(err, "Unable to run the WatchPolicy controller")
+				}
+			}()
+		}
+		klog.V(11).Info("Starting the workload informers")
+		if err := watcher.Run(ctx.Done()); err != nil {
+			klog.Error(err, "Unable to run the configmap watcher")
+			os.Exit(1)
+		}
+		klog.V(11).Info("Exited configmap watcher")
+	}
+	if !leaderElect {
+		run()
+		return
+	}
+
+	// Only the replica holding the lease runs the watcher, the others wait to take over
+	if leaseNamespace == "" {
+		klog.Error("The lease-namespace flag or the POD_NAMESPACE environment variable is required for leader election")
+		os.Exit(1)
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		klog.Error(err, "Unable to get the hostname for the leader election identity")
+		os.Exit(1)
+	}
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, leaseNamespace, leaseName,
+		kubeClient.CoreV1(), kubeClient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
+		klog.Error(err, "Unable to create the leader election lock")
+		os.Exit(1)
+	}
+	// The lease is only released once the watcher has stopped, so the next leader doesn't race its restarts in flight
+	leaseCtx, releaseLease := context.WithCancel(context.Background())
+	leading := make(chan struct{})
+	released := make(chan struct{})
+	go leaderelection.RunOrDie(leaseCtx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            leaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				close(leading)
+			},
+			OnStoppedLeading: func() {
+				if leaseCtx.Err() == nil {
+					// Exit rather than keep watching, so a new leader never races this replica to restart workloads
+					klog.Errorf("Lost the %s/%s lease, exiting", leaseNamespace, leaseName)
+					os.Exit(1)
+				}
+				close(released)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.Infof("%s is the leader, waiting to take over the lease", leader)
+				}
+			},
+		},
+	})
+	select {
+	case <-leading:
+		run()
+	case <-ctx.Done():
+	}
+	releaseLease()
+	<-released
+}
+
+// serve serves the endpoints on the address, exiting if it can't.
+func serve(addr string, mux *http.ServeMux) {
+	klog.Infof("Serving on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Error(err, "Unable to serve on ", addr)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,12 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package apis
+
+import (
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+func init() {
+	// Register the types with the Scheme so the components can map objects to GroupVersionKinds and back
+	AddToSchemes = append(AddToSchemes, v1alpha1.SchemeBuilder.AddToScheme)
+}
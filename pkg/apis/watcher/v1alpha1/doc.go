@@ -0,0 +1,6 @@
+// Copyright Contributors to the Open Cluster Management project
+
+// Package v1alpha1 contains API Schema definitions for the watcher v1alpha1 API group
+// +k8s:deepcopy-gen=package,register
+// +groupName=watcher.ibm.com
+package v1alpha1
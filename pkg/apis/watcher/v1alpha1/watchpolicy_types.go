@@ -0,0 +1,99 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestartStrategy is how the workloads a WatchPolicy selects are restarted when the configmaps or secrets change.
+type RestartStrategy string
+
+const (
+	// RolloutStrategy rolls the workload's pods by changing the config hash annotation on its pod template
+	RolloutStrategy RestartStrategy = "Rollout"
+	// DryRunStrategy only logs, and records as events and metrics, the restarts that would be performed
+	DryRunStrategy RestartStrategy = "DryRun"
+)
+
+// WatchPolicySpec defines the configmaps and secrets the selected workloads watch
+type WatchPolicySpec struct {
+	// Selector selects the deployments, daemonsets, and statefulsets in the policy's namespace that are restarted
+	// when the configmaps or secrets change. An empty selector selects every workload in the namespace.
+	Selector metav1.LabelSelector `json:"selector"`
+	// ConfigMaps are the names of the configmaps in the policy's namespace the workloads watch
+	ConfigMaps []string `json:"configMaps,omitempty"`
+	// ConfigMapKeys limits the restarts to changes to these keys of the configmaps. Every key if empty.
+	ConfigMapKeys []string `json:"configMapKeys,omitempty"`
+	// Secrets are the names of the secrets in the policy's namespace the workloads watch
+	Secrets []string `json:"secrets,omitempty"`
+	// SecretKeys limits the restarts to changes to these keys of the secrets. Every key if empty.
+	SecretKeys []string `json:"secretKeys,omitempty"`
+	// Strategy is how the workloads are restarted, Rollout if empty
+	Strategy RestartStrategy `json:"strategy,omitempty"`
+}
+
+// WatchState is whether the watcher is watching what a workload or WatchPolicy references, or why it isn't.
+type WatchState string
+
+const (
+	// WatchingState is reported once every configmap and secret referenced is being watched
+	WatchingState WatchState = "Watching"
+	// ConfigMapNotFoundState is reported while a configmap or secret referenced doesn't exist, or is in a namespace
+	// the watcher doesn't watch. The workloads are still restarted for the others, and for it once it's created.
+	ConfigMapNotFoundState WatchState = "ConfigMapNotFound"
+	// NamespaceNotAllowedState is reported when the workload or WatchPolicy is in a namespace that isn't allowed
+	NamespaceNotAllowedState WatchState = "NamespaceNotAllowed"
+)
+
+// WatchPolicyConditionType is the type of a WatchPolicy condition.
+type WatchPolicyConditionType string
+
+// WatchingCondition is true once the watcher is watching every configmap and secret the policy references
+const WatchingCondition WatchPolicyConditionType = "Watching"
+
+// WatchPolicyCondition describes the state of a WatchPolicy
+type WatchPolicyCondition struct {
+	Type   WatchPolicyConditionType `json:"type"`
+	Status corev1.ConditionStatus   `json:"status"`
+	// Reason is the WatchState
+	Reason  WatchState `json:"reason,omitempty"`
+	Message string     `json:"message,omitempty"`
+	// LastTransitionTime is when the condition's status last changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// WatchPolicyStatus defines the observed state of WatchPolicy
+type WatchPolicyStatus struct {
+	// Workloads are the workloads the policy selects, as <kind>/<name>
+	Workloads []string `json:"workloads,omitempty"`
+	// Conditions holds the Watching condition
+	Conditions []WatchPolicyCondition `json:"conditions,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WatchPolicy declares the configmaps and secrets a set of workloads watch, in place of annotating each workload
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=watchpolicies,scope=Namespaced
+type WatchPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WatchPolicySpec   `json:"spec,omitempty"`
+	Status WatchPolicyStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WatchPolicyList contains a list of WatchPolicy
+type WatchPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WatchPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&WatchPolicy{}, &WatchPolicyList{})
+}
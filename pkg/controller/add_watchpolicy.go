@@ -0,0 +1,17 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package controller
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/controller/watcher"
+	"github.com/open-cluster-management/configmap-watcher/pkg/controller/watchpolicy"
+)
+
+func init() {
+	// AddToManagerFuncs is a list of functions to create controllers and add them to a manager.
+	AddToManagerFuncs = append(AddToManagerFuncs, func(m manager.Manager, w *watcher.WatcherController) error {
+		return watchpolicy.Add(m, w)
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+// pendingRestart is a workload restart waiting for the changes to its configmaps and secrets to settle.
+type pendingRestart struct {
+	timer *time.Timer
+	// resourceKind and resource are the configmap or secret that changed last, which the restart is recorded against
+	resourceKind string
+	resource     types.NamespacedName
+}
+
+// debouncePeriod returns how long the workload's configmaps and secrets must go unchanged before it's restarted,
+// from its debounce annotation or else the debounce option. It's called with watchedLock held.
+func (w *WatcherController) debouncePeriod(key workload) time.Duration {
+	if refs, ok := w.watchedWorkloads[key]; ok && refs.debounce != nil {
+		return *refs.debounce
+	}
+	return w.debounce
+}
+
+// schedule restarts the workload once the period has passed without another change, putting off the restart
+// already waiting on it if there is one, so a burst of updates causes a single restart. The restart hashes the
+// configmaps and secrets as they are by then. It's called with watchedLock held.
+func (w *WatcherController) schedule(resourceKind string, resource types.NamespacedName, key workload, period time.Duration) {
+	if previous, ok := w.pending[key]; ok {
+		previous.timer.Stop()
+		klog.V(2).Infof("Putting off the restart of %s %s for another %s due to change in %s %s", key.kind, key.name.String(), period, resourceKind, resource.String())
+	} else {
+		klog.Infof("Restarting %s %s once %s %s has gone unchanged for %s", key.kind, key.name.String(), resourceKind, resource.String(), period)
+	}
+	pending := &pendingRestart{resourceKind: resourceKind, resource: resource}
+	pending.timer = time.AfterFunc(period, func() {
+		w.restartPending(key, pending)
+	})
+	w.pending[key] = pending
+}
+
+// restartPending queues the restart of the workload once its period is up, unless the restart has been put off,
+// canceled, or flushed since.
+func (w *WatcherController) restartPending(key workload, pending *pendingRestart) {
+	w.watchedLock.Lock()
+	defer w.watchedLock.Unlock()
+	if w.pending[key] != pending {
+		return
+	}
+	delete(w.pending, key)
+	w.enqueue(pending.resourceKind, pending.resource, key)
+}
+
+// cancelPending drops the restart waiting on a workload that's no longer watched, along with the change it's
+// queued for, so the workers skip it. It's called with watchedLock held.
+func (w *WatcherController) cancelPending(key workload) {
+	delete(w.changes, key)
+	if pending, ok := w.pending[key]; ok {
+		pending.timer.Stop()
+		delete(w.pending, key)
+		klog.V(2).Infof("Canceled the pending restart of %s %s since it's no longer watched", key.kind, key.name.String())
+	}
+}
+
+// flushPending queues the restarts of the workloads still waiting on their period right away, so stopping the
+// watcher doesn't drop the changes they were waiting on.
+func (w *WatcherController) flushPending() {
+	w.watchedLock.Lock()
+	defer w.watchedLock.Unlock()
+	for key, pending := range w.pending {
+		pending.timer.Stop()
+		delete(w.pending, key)
+		klog.Infof("Restarting %s %s without waiting for its debounce period since the watcher is stopping", key.kind, key.name.String())
+		w.enqueue(pending.resourceKind, pending.resource, key)
+	}
+}
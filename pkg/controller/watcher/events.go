@@ -0,0 +1,114 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+const (
+	eventComponent      string = "configmap-watcher"
+	restartedReason     string = "Restarted"
+	restartFailedReason string = "RestartFailed"
+	dryRunReason        string = "DryRunRestart"
+	restoreFailedReason string = "RestoreFailed"
+)
+
+// newRecorder returns an event broadcaster and a recorder for it. The broadcaster only sends the events to the API
+// server once Run starts recording them.
+func newRecorder() (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	return broadcaster, broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// startRecording sends the recorded events to the API server until the returned function is called.
+func (w *WatcherController) startRecording() func() {
+	logging := w.broadcaster.StartLogging(func(format string, args ...interface{}) {
+		klog.V(4).Infof(format, args...)
+	})
+	recording := w.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: w.client.CoreV1().Events("")})
+	return func() {
+		logging.Stop()
+		recording.Stop()
+	}
+}
+
+// recordRestart records an event against both the configmap or secret that changed and the workload it restarted,
+// or failed to restart, so the workload's owners can see why its pods rolled with kubectl describe.
+func (w *WatcherController) recordRestart(resourceKind string, resource types.NamespacedName, key workload, err error) {
+	resourceRef := w.resourceReference(resourceKind, resource)
+	workloadRef := w.workloadReference(key)
+	if err != nil {
+		w.recorder.Eventf(resourceRef, corev1.EventTypeWarning, restartFailedReason, "Unable to restart %s %s: %v", key.kind, key.name.String(), err)
+		w.recorder.Eventf(workloadRef, corev1.EventTypeWarning, restartFailedReason, "Unable to restart due to change in %s %s: %v", resourceKind, resource.String(), err)
+		return
+	}
+	w.recorder.Eventf(resourceRef, corev1.EventTypeNormal, restartedReason, "Restarted %s %s due to change in %s %s", key.kind, key.name.String(), resourceKind, resource.String())
+	w.recorder.Eventf(workloadRef, corev1.EventTypeNormal, restartedReason, "Restarted due to change in %s %s", resourceKind, resource.String())
+}
+
+// recordDryRun records an event against both the configmap or secret that changed and the workload in dry run,
+// describing the restart that was skipped.
+func (w *WatcherController) recordDryRun(resourceKind string, resource types.NamespacedName, key workload) {
+	w.recorder.Eventf(w.resourceReference(resourceKind, resource), corev1.EventTypeNormal, dryRunReason, "Would restart %s %s due to change in %s %s, skipped in dry run", key.kind, key.name.String(), resourceKind, resource.String())
+	w.recorder.Eventf(w.workloadReference(key), corev1.EventTypeNormal, dryRunReason, "Would restart due to change in %s %s, skipped in dry run", resourceKind, resource.String())
+}
+
+// resourceReference refers to the configmap or secret, with its UID from the informer cache when it's there since
+// kubectl describe only shows the events referring to the UID of the object.
+func (w *WatcherController) resourceReference(resourceKind string, resource types.NamespacedName) *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: resource.Namespace, Name: resource.Name}
+	stores := w.configmapStores
+	if resourceKind == secretKind {
+		ref.Kind = "Secret"
+		stores = w.secretStores
+	}
+	if obj, ok := lookup(stores, resource); ok {
+		if object, err := meta.Accessor(obj); err == nil {
+			ref.UID = object.GetUID()
+		}
+	}
+	return ref
+}
+
+// workloadReference refers to the workload, with the UID it had when it was registered.
+func (w *WatcherController) workloadReference(key workload) *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{APIVersion: "apps/v1", Namespace: key.name.Namespace, Name: key.name.Name}
+	switch key.kind {
+	case deploymentKind:
+		ref.Kind = "Deployment"
+	case daemonsetKind:
+		ref.Kind = "DaemonSet"
+	case statefulsetKind:
+		ref.Kind = "StatefulSet"
+	case cronjobKind:
+		ref.APIVersion = "batch/v1beta1"
+		if w.cronjobsV1 {
+			ref.APIVersion = batchV1Cronjobs.Kind.GroupVersion().String()
+		}
+		ref.Kind = "CronJob"
+	case jobKind:
+		ref.APIVersion = "batch/v1"
+		ref.Kind = "Job"
+	case podKind:
+		ref.APIVersion = "v1"
+		ref.Kind = "Pod"
+	default:
+		if kind, ok := w.workloadKinds[key.kind]; ok {
+			ref.APIVersion = kind.Kind.GroupVersion().String()
+			ref.Kind = kind.Kind.Kind
+		}
+	}
+	w.watchedLock.Lock()
+	defer w.watchedLock.Unlock()
+	if refs, ok := w.watchedWorkloads[key]; ok {
+		ref.UID = refs.uid
+	}
+	return ref
+}
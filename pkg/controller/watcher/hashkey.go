@@ -0,0 +1,64 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// hashKeyData is the entry of the hash key secret holding the key
+	hashKeyData string = "key"
+	// hashKeyLength is the length in bytes of the keys generated
+	hashKeyLength int = 32
+)
+
+// newHashKey returns a random key for the config hashes.
+func newHashKey() ([]byte, error) {
+	key := make([]byte, hashKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadHashKey returns the key the config hashes are keyed with, from the named secret, creating the secret with a
+// random key if it doesn't exist yet. Every replica, and every run of the watcher, reads the same key, so the same
+// data keeps hashing the same.
+func LoadHashKey(client kubernetes.Interface, namespace, name string) ([]byte, error) {
+	secretInterface := client.CoreV1().Secrets(namespace)
+	secret, err := secretInterface.Get(name, metav1.GetOptions{})
+	if err == nil {
+		if key := secret.Data[hashKeyData]; len(key) > 0 {
+			return key, nil
+		}
+		return nil, fmt.Errorf("secret %s/%s has no %q entry", namespace, name, hashKeyData)
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	key, err := newHashKey()
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Creating secret %s/%s holding the config hash key", namespace, name)
+	_, err = secretInterface.Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       map[string][]byte{hashKeyData: key},
+	})
+	if errors.IsAlreadyExists(err) {
+		// Another replica created it first
+		return LoadHashKey(client, namespace, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,47 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestLoadHashKey(t *testing.T) {
+	empty := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "watcher"}}
+	simpleClient := testclient.NewSimpleClientset(empty)
+
+	// The key is generated once, and read back after that
+	key, err := LoadHashKey(simpleClient, "watcher", "hash-key")
+	assert.Nil(t, err)
+	assert.Len(t, key, hashKeyLength)
+	again, err := LoadHashKey(simpleClient, "watcher", "hash-key")
+	assert.Nil(t, err)
+	assert.Equal(t, key, again)
+
+	_, err = LoadHashKey(simpleClient, "watcher", "empty")
+	assert.NotNil(t, err)
+}
+
+func TestKeyedConfigHash(t *testing.T) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"}, Data: map[string][]byte{"password": []byte("hunter2")}}
+	key := workload{kind: deploymentKind, name: splitNamespacedName("default/app")}
+	hash := func(hashKey []byte) string {
+		watcher := Init(testclient.NewSimpleClientset(), Options{HashKey: hashKey})
+		watcher.secretStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+		assert.Nil(t, watcher.secretStores[""].Add(secret))
+		watcher.watchedWorkloads[key] = &references{secrets: []types.NamespacedName{splitNamespacedName("default/secret")}}
+		return watcher.configHash(key)
+	}
+
+	// The same key gives the same hash, another key another one
+	assert.Equal(t, hash([]byte("one")), hash([]byte("one")))
+	assert.NotEqual(t, hash([]byte("one")), hash([]byte("two")))
+	assert.NotEqual(t, hash(nil), hash(nil))
+}
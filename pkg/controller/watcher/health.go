@@ -0,0 +1,99 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// defaultUnhealthyAfter is how long the event handlers may stall, or the API server be unreachable, before the
+// watcher reports itself unhealthy when Options doesn't set it.
+const defaultUnhealthyAfter time.Duration = 2 * time.Minute
+
+// health holds what the health and readiness checks report on.
+type health struct {
+	sync.Mutex
+	// running is set while Run is, and synced once its informers have synced
+	running bool
+	synced  bool
+	// lastProgress is when the event handlers were last seen idle, lastContact when the API server last answered
+	lastProgress time.Time
+	lastContact  time.Time
+}
+
+// Healthz returns an error once the event handlers have been stuck, or the API server unreachable, for longer
+// than the unhealthy period.
+func (w *WatcherController) Healthz() error {
+	_, err := w.client.Discovery().ServerVersion()
+	now := time.Now()
+
+	w.health.Lock()
+	defer w.health.Unlock()
+	if err == nil {
+		w.health.lastContact = now
+	} else if now.Sub(w.health.lastContact) > w.unhealthyAfter {
+		return fmt.Errorf("the API server has been unreachable since %s: %v", w.health.lastContact.Format(time.RFC3339), err)
+	}
+	if w.health.running && now.Sub(w.health.lastProgress) > w.unhealthyAfter {
+		return fmt.Errorf("the event handlers have been stalled since %s", w.health.lastProgress.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Readyz returns an error while Run is waiting for the informers to sync. A watcher that isn't running, such as
+// a replica waiting to be elected leader, is ready so it doesn't hold up rollouts.
+func (w *WatcherController) Readyz() error {
+	w.health.Lock()
+	defer w.health.Unlock()
+	if w.health.running && !w.health.synced {
+		return errors.New("the informers haven't synced yet")
+	}
+	return nil
+}
+
+// HealthHandler serves the result of a health or readiness check, a 500 with the error if it fails.
+func HealthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := check(); err != nil {
+			klog.Errorf("Failed %s: %s", req.URL.Path, err.Error())
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(rw, "ok") /* #nosec G104 */
+	})
+}
+
+// setRunning records whether Run is running, starting the stall checks over.
+func (w *WatcherController) setRunning(running bool) {
+	w.health.Lock()
+	defer w.health.Unlock()
+	w.health.running = running
+	w.health.synced = false
+	w.health.lastProgress = time.Now()
+}
+
+// setSynced records that the informers have synced.
+func (w *WatcherController) setSynced() {
+	w.health.Lock()
+	defer w.health.Unlock()
+	w.health.synced = true
+}
+
+// heartbeat records that the event handlers are making progress, by taking the lock they hold while handling an
+// event, until stopCh is closed. A handler stuck holding the lock stops the heartbeat.
+func (w *WatcherController) heartbeat(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		w.watchedLock.Lock()
+		w.watchedLock.Unlock() // nolint:staticcheck
+		w.health.Lock()
+		w.health.lastProgress = time.Now()
+		w.health.Unlock()
+	}, w.unhealthyAfter/4, stopCh)
+}
@@ -0,0 +1,62 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestHealthz(t *testing.T) {
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	assert.Nil(t, watcher.Healthz())
+
+	// Event handlers that haven't let go of the lock for too long are stalled
+	watcher.setRunning(true)
+	assert.Nil(t, watcher.Healthz())
+	watcher.health.lastProgress = time.Now().Add(-3 * time.Minute)
+	err := watcher.Healthz()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "stalled")
+	watcher.setRunning(false)
+	assert.Nil(t, watcher.Healthz())
+
+	// An unreachable API server is only unhealthy once it's been unreachable for too long
+	unreachable := kubernetes.NewForConfigOrDie(&rest.Config{Host: "http://127.0.0.1:1"})
+	assert.Nil(t, Init(unreachable, Options{UnhealthyAfter: time.Hour}).Healthz())
+	watcher = Init(unreachable, Options{UnhealthyAfter: time.Millisecond})
+	time.Sleep(10 * time.Millisecond)
+	err = watcher.Healthz()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unreachable")
+}
+
+func TestReadyz(t *testing.T) {
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	// Not running, such as waiting to be elected leader
+	assert.Nil(t, watcher.Readyz())
+	watcher.setRunning(true)
+	assert.NotNil(t, watcher.Readyz())
+	watcher.setSynced()
+	assert.Nil(t, watcher.Readyz())
+}
+
+func TestHealthHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	HealthHandler(func() error { return nil }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	HealthHandler(func() error { return errors.New("not synced") }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "not synced")
+}
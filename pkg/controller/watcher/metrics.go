@@ -0,0 +1,113 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace string = "configmap_watcher"
+
+var (
+	watchedResourcesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "watched_resources",
+		Help:      "Number of configmaps and secrets watched by at least one workload.",
+	}, []string{"resource"})
+	watchedWorkloadsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "watched_workloads",
+		Help:      "Number of opted-in workloads watching at least one configmap or secret.",
+	}, []string{"kind"})
+	restartsAttempted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarts_attempted_total",
+		Help:      "Number of workload restarts attempted.",
+	}, []string{"kind", "namespace"})
+	restartsSucceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarts_succeeded_total",
+		Help:      "Number of workload restarts that succeeded.",
+	}, []string{"kind", "namespace"})
+	restartsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarts_failed_total",
+		Help:      "Number of workload restarts that failed.",
+	}, []string{"kind", "namespace"})
+	restartsDryRun = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarts_dry_run_total",
+		Help:      "Number of workload restarts skipped since the watcher or the workload is in dry run.",
+	}, []string{"kind", "namespace"})
+	restartsRetried = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarts_retried_total",
+		Help:      "Number of failed workload restarts queued to be retried.",
+	}, []string{"kind", "namespace"})
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "restart_queue_depth",
+		Help:      "Number of workload restarts waiting for a worker.",
+	})
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time taken to handle a configmap, secret, or workload event, including the restarts it causes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler"})
+	informersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "informers",
+		Help:      "Number of informers running.",
+	})
+	removedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "removed_total",
+		Help:      "Number of configmaps and secrets dropped from the watched list since nothing watches them anymore.",
+	}, []string{"resource"})
+)
+
+// Registry holds the watcher's metrics, along with the Go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		watchedResourcesGauge,
+		watchedWorkloadsGauge,
+		restartsAttempted,
+		restartsSucceeded,
+		restartsFailed,
+		restartsDryRun,
+		restartsRetried,
+		queueDepth,
+		handlerDuration,
+		informersGauge,
+		removedTotal,
+	)
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// observeWatched sets the watched gauges from the watched maps. It's called with watchedLock held.
+func (w *WatcherController) observeWatched() {
+	watchedResourcesGauge.WithLabelValues(configmapKind).Set(float64(len(w.watchedConfigmaps)))
+	watchedResourcesGauge.WithLabelValues(secretKind).Set(float64(len(w.watchedSecrets)))
+	counts := map[string]int{deploymentKind: 0, daemonsetKind: 0, statefulsetKind: 0, cronjobKind: 0, jobKind: 0, podKind: 0}
+	for name := range w.workloadKinds {
+		counts[name] = 0
+	}
+	for key := range w.watchedWorkloads {
+		counts[key.kind]++
+	}
+	for kind, count := range counts {
+		watchedWorkloadsGauge.WithLabelValues(kind).Set(float64(count))
+	}
+}
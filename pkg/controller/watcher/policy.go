@@ -0,0 +1,155 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+// annotationSource is the source of the references named in a workload's own annotations.
+const annotationSource string = "annotations"
+
+// policySource is the source of the references a WatchPolicy has for the workloads it selects.
+func policySource(policy types.NamespacedName) string {
+	return "watchpolicy " + policy.String()
+}
+
+// SetPolicy has the workloads a WatchPolicy selects watch its configmaps and secrets, along with those named in
+// their own annotations, and stops the workloads it no longer selects from watching them. The workloads are
+// deployments, daemonsets, and statefulsets in the policy's namespace. A policy in a namespace that isn't allowed
+// selects nothing. The status of the workloads is reported, and the state of the policy is returned along with a
+// message explaining it, or an empty state until the informers have synced.
+func (w *WatcherController) SetPolicy(policy *v1alpha1.WatchPolicy, workloads []runtime.Object) (v1alpha1.WatchState, string) {
+	name := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+	source := policySource(name)
+	selected := make(map[workload]metav1.Object, len(workloads))
+	_, allowed := w.allowedNamespaces[name.Namespace]
+	allowed = allowed || !w.restrictNamespaces
+	if !allowed {
+		klog.Errorf("Ignoring WatchPolicy %s since it's not in an allowed namespace", name.String())
+	} else {
+		for _, obj := range workloads {
+			kind, object, ok := workloadMeta(obj)
+			if !ok || object.GetNamespace() != name.Namespace {
+				klog.Errorf("Ignoring %T %s/%s selected by WatchPolicy %s", obj, object.GetNamespace(), object.GetName(), name.String())
+				continue
+			}
+			selected[workload{kind: kind, name: types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()}}] = object
+		}
+	}
+
+	var updates []statusUpdate
+	w.watchedLock.Lock()
+	for key, sources := range w.sources {
+		if _, ok := sources[source]; !ok {
+			continue
+		}
+		if _, ok := selected[key]; !ok {
+			klog.Infof("WatchPolicy %s no longer selects %s %s", name.String(), key.kind, key.name.String())
+			w.registerSource(key, source, nil)
+			if update, ok := w.refreshStatus(key, w.statuses[key]); ok {
+				updates = append(updates, update)
+			}
+		}
+	}
+	for key, object := range selected {
+		klog.V(2).Infof("WatchPolicy %s selects %s %s", name.String(), key.kind, key.name.String())
+		refs := policyReferences(policy)
+		refs.uid = object.GetUID()
+		current := w.observeStatus(key, object.GetAnnotations())
+		w.registerSource(key, source, refs)
+		if update, ok := w.refreshStatus(key, current); ok {
+			updates = append(updates, update)
+		}
+	}
+	state, message := w.policyState(policy, allowed)
+	w.watchedLock.Unlock()
+	w.writeStatuses(updates)
+	return state, message
+}
+
+// policyState returns the state of the policy and a message explaining it, or an empty state until the informers have
+// synced. It's called with watchedLock held.
+func (w *WatcherController) policyState(policy *v1alpha1.WatchPolicy, allowed bool) (v1alpha1.WatchState, string) {
+	if !allowed {
+		return v1alpha1.NamespaceNotAllowedState, fmt.Sprintf("Namespace %s isn't allowed", policy.Namespace)
+	}
+	if !w.reporting {
+		return "", ""
+	}
+	if missing := w.missingReferences(policyReferences(policy)); len(missing) > 0 {
+		return v1alpha1.ConfigMapNotFoundState, "Unable to find " + strings.Join(missing, ", ")
+	}
+	return v1alpha1.WatchingState, "Watching every configmap and secret"
+}
+
+// RemovePolicy stops the workloads a deleted WatchPolicy selected from watching its configmaps and secrets.
+func (w *WatcherController) RemovePolicy(policy types.NamespacedName) {
+	source := policySource(policy)
+	var updates []statusUpdate
+	w.watchedLock.Lock()
+	for key, sources := range w.sources {
+		if _, ok := sources[source]; ok {
+			klog.Infof("WatchPolicy %s was removed, it no longer selects %s %s", policy.String(), key.kind, key.name.String())
+			w.registerSource(key, source, nil)
+			if update, ok := w.refreshStatus(key, w.statuses[key]); ok {
+				updates = append(updates, update)
+			}
+		}
+	}
+	w.watchedLock.Unlock()
+	w.writeStatuses(updates)
+}
+
+// policyReferences returns the configmaps and secrets the policy references, and the keys of them it subscribes to.
+func policyReferences(policy *v1alpha1.WatchPolicy) *references {
+	refs := &references{}
+	for _, name := range policy.Spec.ConfigMaps {
+		refs.configmaps = append(refs.configmaps, types.NamespacedName{Namespace: policy.Namespace, Name: name})
+	}
+	if len(policy.Spec.ConfigMapKeys) > 0 {
+		refs.configmapKeys = keyFilter{}
+		for _, key := range policy.Spec.ConfigMapKeys {
+			refs.configmapKeys[key] = struct{}{}
+		}
+	}
+	for _, name := range policy.Spec.Secrets {
+		refs.secrets = append(refs.secrets, types.NamespacedName{Namespace: policy.Namespace, Name: name})
+	}
+	if len(policy.Spec.SecretKeys) > 0 {
+		refs.secretKeys = keyFilter{}
+		for _, key := range policy.Spec.SecretKeys {
+			refs.secretKeys[key] = struct{}{}
+		}
+	}
+	switch policy.Spec.Strategy {
+	case "", v1alpha1.RolloutStrategy:
+	case v1alpha1.DryRunStrategy:
+		refs.dryRun = true
+	default:
+		klog.Errorf("Unknown strategy %q in WatchPolicy %s/%s, rolling the workloads out", policy.Spec.Strategy, policy.Namespace, policy.Name)
+	}
+	return refs
+}
+
+// workloadMeta returns the kind and metadata of a deployment, daemonset, or statefulset.
+func workloadMeta(obj runtime.Object) (string, metav1.Object, bool) {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		return deploymentKind, workload, true
+	case *appsv1.DaemonSet:
+		return daemonsetKind, workload, true
+	case *appsv1.StatefulSet:
+		return statefulsetKind, workload, true
+	}
+	return "", &metav1.ObjectMeta{}, false
+}
@@ -0,0 +1,83 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+func TestSetPolicy(t *testing.T) {
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	policy := &v1alpha1.WatchPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: "default"},
+		Spec: v1alpha1.WatchPolicySpec{
+			ConfigMaps:    []string{"policy-config"},
+			ConfigMapKeys: []string{"app.yaml"},
+			Strategy:      v1alpha1.DryRunStrategy,
+		},
+	}
+	policyName := types.NamespacedName{Namespace: "default", Name: "policy"}
+	policyConfig := splitNamespacedName("default/policy-config")
+	annotatedConfig := splitNamespacedName("default/annotated-config")
+	key := workload{kind: deploymentKind, name: splitNamespacedName("default/app")}
+	app := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "app-uid"}}
+	elsewhere := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "other"}}
+
+	// The selected workloads watch the policy's configmaps, the workloads in other namespaces are ignored. The state
+	// isn't known until the informers have synced.
+	state, _ := watcher.SetPolicy(policy, []runtime.Object{app, elsewhere})
+	assert.Empty(t, state)
+	assert.Contains(t, watcher.watchedConfigmaps, policyConfig)
+	assert.Contains(t, watcher.watchedConfigmaps[policyConfig].Deployments, key.name)
+	assert.Len(t, watcher.watchedWorkloads, 1)
+	assert.Equal(t, types.UID("app-uid"), watcher.watchedWorkloads[key].uid)
+	assert.True(t, watcher.watchedWorkloads[key].dryRun)
+	assert.Equal(t, keyFilter{"app.yaml": {}}, watcher.watchedWorkloads[key].configmapKeys)
+
+	// Along with the configmaps in their annotations
+	watcher.register(key, annotationSource, &references{configmaps: []types.NamespacedName{annotatedConfig}})
+	assert.ElementsMatch(t, []types.NamespacedName{policyConfig, annotatedConfig}, watcher.watchedWorkloads[key].configmaps)
+	assert.Nil(t, watcher.watchedWorkloads[key].configmapKeys)
+
+	// The policy's configmap doesn't exist
+	watcher.configmapStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	watcher.secretStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	watcher.startReporting()
+	state, message := watcher.SetPolicy(policy, []runtime.Object{app})
+	assert.Equal(t, v1alpha1.ConfigMapNotFoundState, state)
+	assert.Equal(t, "Unable to find configmap default/policy-config", message)
+	assert.Nil(t, watcher.configmapStores[""].Add(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "policy-config", Namespace: "default"}}))
+	state, _ = watcher.SetPolicy(policy, []runtime.Object{app})
+	assert.Equal(t, v1alpha1.WatchingState, state)
+
+	// A workload the policy no longer selects only watches what its annotations name
+	watcher.SetPolicy(policy, nil)
+	assert.NotContains(t, watcher.watchedConfigmaps, policyConfig)
+	assert.Equal(t, []types.NamespacedName{annotatedConfig}, watcher.watchedWorkloads[key].configmaps)
+	assert.False(t, watcher.watchedWorkloads[key].dryRun)
+
+	// And once the policy is removed
+	watcher.SetPolicy(policy, []runtime.Object{app})
+	watcher.RemovePolicy(policyName)
+	assert.NotContains(t, watcher.watchedConfigmaps, policyConfig)
+	watcher.register(key, annotationSource, nil)
+	assert.Empty(t, watcher.watchedWorkloads)
+	assert.Empty(t, watcher.sources)
+
+	// Policies in namespaces that aren't allowed select nothing
+	watcher = Init(testclient.NewSimpleClientset(), Options{RestrictNamespaces: true, AllowedNamespaces: map[string]struct{}{"other": {}}})
+	state, _ = watcher.SetPolicy(policy, []runtime.Object{app})
+	assert.Equal(t, v1alpha1.NamespaceNotAllowedState, state)
+	assert.Empty(t, watcher.watchedWorkloads)
+}
@@ -0,0 +1,167 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+const (
+	// defaultWorkers is how many restarts are performed at once when Options doesn't set it
+	defaultWorkers int = 2
+	// maxRestartRetries is how many times a failed restart is retried before it's dropped, backing off from
+	// retryBaseDelay up to retryMaxDelay between attempts
+	maxRestartRetries int           = 10
+	retryBaseDelay    time.Duration = time.Second
+	retryMaxDelay     time.Duration = 5 * time.Minute
+)
+
+// change is the configmap or secret change a queued restart is recorded against.
+type change struct {
+	resourceKind string
+	resource     types.NamespacedName
+}
+
+// newQueue returns the queue of workloads to restart, which backs off exponentially from the failed restarts.
+func newQueue() workqueue.RateLimitingInterface {
+	rateLimiter := workqueue.NewItemExponentialFailureRateLimiter(retryBaseDelay, retryMaxDelay)
+	return workqueue.NewNamedRateLimitingQueue(rateLimiter, "restarts")
+}
+
+// newThrottle returns the rate limiter capping the restarts performed per minute, or nil for no cap.
+func newThrottle(restartsPerMinute int) *rate.Limiter {
+	if restartsPerMinute <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(float64(restartsPerMinute)/60), 1)
+}
+
+// enqueue queues a restart of the workload due to the change. A workload already queued is restarted once, against
+// the latest change. It's called with watchedLock held.
+func (w *WatcherController) enqueue(resourceKind string, resource types.NamespacedName, key workload) {
+	w.changes[key] = &change{resourceKind: resourceKind, resource: resource}
+	w.queue.Add(key)
+	queueDepth.Set(float64(w.queue.Len()))
+}
+
+// runWorker performs the queued restarts until the queue is shut down.
+func (w *WatcherController) runWorker() {
+	for w.processNextRestart() {
+	}
+}
+
+// processNextRestart restarts the next workload on the queue. A failed restart is retried with an exponential
+// backoff, up to maxRestartRetries times. It returns false once the queue has been shut down and drained.
+func (w *WatcherController) processNextRestart() bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(item)
+	queueDepth.Set(float64(w.queue.Len()))
+	key := item.(workload)
+	w.watchedLock.Lock()
+	cause := w.changes[key]
+	w.watchedLock.Unlock()
+
+	err := w.restart(key)
+	switch {
+	case err == nil:
+		w.queue.Forget(key)
+	case w.queue.NumRequeues(key) < maxRestartRetries:
+		klog.Infof("Retrying the restart of %s %s, attempt %d of %d",
+			key.kind, key.name.String(), w.queue.NumRequeues(key)+1, maxRestartRetries)
+		restartsRetried.WithLabelValues(key.kind, key.name.Namespace).Inc()
+		w.queue.AddRateLimited(key)
+	default:
+		klog.Errorf("Dropping the restart of %s %s after %d retries", key.kind, key.name.String(), maxRestartRetries)
+		w.queue.Forget(key)
+		// A change recorded since is kept, and restarts the workload when it's queued again
+		w.handled(key, cause)
+	}
+	return true
+}
+
+// restart restarts the workload with the current hash of the configmaps and secrets it watches, or only logs it
+// in dry run, waiting on the cap on restarts per minute first. The wait ends once Run's shutdown grace period runs
+// out, and the restart is dropped. A failure is logged, counted, and recorded as events before it's returned.
+// Workloads that aren't watched anymore, or whose change was already handled, are skipped. Workloads with the signal
+// strategy have their pods sent the signal instead. The workload's status is reported once it's restarted.
+func (w *WatcherController) restart(key workload) error {
+	w.watchedLock.Lock()
+	cause, ok := w.changes[key]
+	dryRun := w.isDryRun(key)
+	var signal *reloadSignal
+	var podSelector *metav1.LabelSelector
+	var uid types.UID
+	if refs, ok := w.watchedWorkloads[key]; ok {
+		signal, podSelector, uid = refs.signal, refs.podSelector, refs.uid
+	}
+	w.watchedLock.Unlock()
+	if !ok {
+		klog.V(3).Infof("Skipping the restart of %s %s since there's no change to restart it for",
+			key.kind, key.name.String())
+		return nil
+	}
+	if !dryRun && w.throttle != nil {
+		if err := w.throttle.Wait(w.stopping); err != nil {
+			klog.Infof("Dropping the restart of %s %s waiting on the cap on restarts per minute: %s",
+				key.kind, key.name.String(), err.Error())
+			return nil
+		}
+	}
+	// Hashed after waiting on the cap, so the restart has the configmaps and secrets as they are by then
+	w.watchedLock.Lock()
+	hash := w.configHash(key)
+	w.watchedLock.Unlock()
+
+	if dryRun {
+		w.observeDryRun(cause.resourceKind, cause.resource, key, hash)
+		w.handled(key, cause)
+		w.reportRestart(key, false)
+		return nil
+	}
+	var err error
+	if signal != nil {
+		err = w.signalPods(key, signal, podSelector, uid, hash)
+	} else if kind, ok := w.dynamicKind(key.kind); ok {
+		err = restartWorkload(w.dynamicClient, kind, key.name, hash)
+	} else {
+		switch key.kind {
+		case deploymentKind, daemonsetKind, statefulsetKind, cronjobKind:
+			err = restartTemplate(w.client, key.kind, key.name, hash)
+		case jobKind:
+			err = restartJob(w.client, w.recorder, key.name, hash, w.recreateJobs)
+		case podKind:
+			err = restartPod(w.client, key.name, hash, w.recreatePods)
+		default:
+			err = fmt.Errorf("unknown workload kind %q", key.kind)
+		}
+	}
+	w.observeRestart(cause.resourceKind, cause.resource, key, err)
+	if err != nil {
+		klog.Errorf("Unable to restart pods associated with %s %s, error message: %s", key.kind, key.name.Name, err.Error())
+		atomic.AddUint64(&w.failures, 1)
+		return fmt.Errorf("%s %s: %v", key.kind, key.name.String(), err)
+	}
+	w.handled(key, cause)
+	w.reportRestart(key, true)
+	return nil
+}
+
+// handled forgets the change the workload was restarted for, unless another change has been queued since.
+func (w *WatcherController) handled(key workload, cause *change) {
+	w.watchedLock.Lock()
+	defer w.watchedLock.Unlock()
+	if w.changes[key] == cause {
+		delete(w.changes, key)
+	}
+}
@@ -3,94 +3,417 @@
 package watcher
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	batchv1client "k8s.io/client-go/kubernetes/typed/batch/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog"
 )
 
-// RestartAll calls the restart functions for every deployment/daemonset/statefulset that is watching
-// the configmap that was updated.
-func RestartAll(client kubernetes.Interface, configmap types.NamespacedName, watchedConfigmaps map[types.NamespacedName]*ConfigMapper) {
-	klog.V(3).Infof("Configmap update %v", configmap)
+// RestartAll queues a restart for every workload that is watching the configmap or secret that was updated and
+// subscribes to one of its changed keys. Nil changed keys restart every workload watching it.
+// Workloads with a debounce period are queued once the changes have settled instead, see schedule. The restarts
+// are performed by the workers, see processNextRestart. It's called with watchedLock held.
+func (w *WatcherController) RestartAll(resourceKind string, configmap types.NamespacedName, changed map[string]struct{}) {
+	klog.V(3).Infof("Update to %s %v", resourceKind, configmap)
 	// Get the configmapper
-	configmapper := watchedConfigmaps[configmap]
+	watched := w.watchedConfigmaps
+	if resourceKind == secretKind {
+		watched = w.watchedSecrets
+	}
+	configmapper, ok := watched[configmap]
+	if !ok {
+		klog.V(3).Infof("Nothing is watching %v anymore", configmap)
+		return
+	}
 
-	// Restart deployments
-	for kind := range configmapper.Deployments {
-		if err := restartDeployment(client, kind); err != nil {
-			klog.Errorf("Unable to restart pods associated with deployment %s, error message: %s", kind.Name, err.Error())
+	for _, key := range configmapper.workloads(changed) {
+		if period := w.debouncePeriod(key); period > 0 {
+			w.schedule(resourceKind, configmap, key, period)
+			continue
 		}
+		w.enqueue(resourceKind, configmap, key)
+	}
+}
+
+// observeRestart counts an attempted restart of a workload, and whether it succeeded or failed, and records it
+// as events.
+func (w *WatcherController) observeRestart(resourceKind string, resource types.NamespacedName, key workload, err error) {
+	w.recordRestart(resourceKind, resource, key, err)
+	restartsAttempted.WithLabelValues(key.kind, key.name.Namespace).Inc()
+	if err != nil {
+		restartsFailed.WithLabelValues(key.kind, key.name.Namespace).Inc()
+		return
+	}
+	restartsSucceeded.WithLabelValues(key.kind, key.name.Namespace).Inc()
+}
+
+// isDryRun is true if restarts of the workload are only logged, because of the dry-run option or the workload's
+// dry-run annotation. It's called with watchedLock held.
+func (w *WatcherController) isDryRun(key workload) bool {
+	if w.dryRun {
+		return true
+	}
+	refs, ok := w.watchedWorkloads[key]
+	return ok && refs.dryRun
+}
+
+// observeDryRun logs, counts, and records as events the restart of a workload in dry run.
+func (w *WatcherController) observeDryRun(resourceKind string, resource types.NamespacedName, key workload, hash string) {
+	klog.Infof("Dry run: would restart %s %s with config hash %s due to change in %s %s", key.kind, key.name.String(), hash, resourceKind, resource.String())
+	w.recordDryRun(resourceKind, resource, key)
+	restartsDryRun.WithLabelValues(key.kind, key.name.Namespace).Inc()
+}
+
+// Failures returns the number of restarts that have failed since the controller was initialized.
+func (w *WatcherController) Failures() uint64 {
+	return atomic.LoadUint64(&w.failures)
+}
+
+// configHash returns an HMAC-SHA256, keyed with the hash key, of the data in the configmaps and secrets the workload
+// watches, limited to the keys it subscribes to. The same data always hashes the same, so reverting a configmap
+// reverts the hash, while the key keeps the secrets' data from being guessed from the hash. It's called with
+// watchedLock held.
+func (w *WatcherController) configHash(key workload) string {
+	hash := hmac.New(sha256.New, w.hashKey)
+	refs, ok := w.watchedWorkloads[key]
+	if !ok {
+		return hex.EncodeToString(hash.Sum(nil))
 	}
-	// Restart daemonsets
-	for kind := range configmapper.Daemonsets {
-		if err := restartDaemonset(client, kind); err != nil {
-			klog.Errorf("Unable to restart pods associated with daemonset %s, error message: %s", kind.Name, err.Error())
+	for _, name := range sortedNames(refs.configmaps) {
+		fmt.Fprintf(hash, "configmap\x00%s\x00", name.String())
+		obj, ok := lookup(w.configmapStores, name)
+		if !ok {
+			continue
+		}
+		configmap, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			continue
+		}
+		data := make(map[string][]byte, len(configmap.Data)+len(configmap.BinaryData))
+		for k, v := range configmap.Data {
+			data[k] = []byte(v)
 		}
+		for k, v := range configmap.BinaryData {
+			data[k] = v
+		}
+		hashData(hash, data, refs.configmapKeys)
 	}
-	// Restart statefulset
-	for kind := range configmapper.Statefulsets {
-		if err := restartStatefulset(client, kind); err != nil {
-			klog.Errorf("Unable to restart pods associated with statefulset %s, error message: %s", kind.Name, err.Error())
+	for _, name := range sortedNames(refs.secrets) {
+		fmt.Fprintf(hash, "secret\x00%s\x00", name.String())
+		if obj, ok := lookup(w.secretStores, name); ok {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				hashData(hash, secret.Data, refs.secretKeys)
+			}
 		}
 	}
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
-func restartDeployment(client kubernetes.Interface, deploymentName types.NamespacedName) error {
-	update := time.Now().Format("2006-1-2.1504")
-	klog.Infof("Restarting deployment %s at %s", deploymentName.String(), update)
-	deploymentsInterface := client.AppsV1().Deployments(deploymentName.Namespace)
-	deployment, err := deploymentsInterface.Get(deploymentName.Name, metav1.GetOptions{})
-	if err != nil {
-		klog.Errorf("error occurred getting deployment %v", deployment)
-		return err
+// hashData writes the subscribed keys of the data, and their values, to the hash in a stable order.
+func hashData(out io.Writer, data map[string][]byte, keys keyFilter) {
+	sorted := make([]string, 0, len(data))
+	for k := range data {
+		if keys == nil {
+			sorted = append(sorted, k)
+		} else if _, ok := keys[k]; ok {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		fmt.Fprintf(out, "%s\x00%d\x00", k, len(data[k]))
+		out.Write(data[k]) /* #nosec G104 */
+	}
+}
+
+// sortedNames returns a sorted copy of the names.
+func sortedNames(names []types.NamespacedName) []types.NamespacedName {
+	sorted := append([]types.NamespacedName(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+	return sorted
+}
+
+// templatePath returns the path to the pod template patched to restart a deployment, daemonset, statefulset, or
+// cronjob, whose pod template is in its job template.
+func templatePath(kind string) []string {
+	if kind == cronjobKind {
+		return []string{"spec", "jobTemplate", "spec", "template"}
 	}
-	deployment.ObjectMeta.Labels[restartLabel] = update
-	deployment.Spec.Template.ObjectMeta.Labels[restartLabel] = update
-	_, err = deploymentsInterface.Update(deployment)
+	return []string{"spec", "template"}
+}
+
+// getTemplateWorkload gets the deployment, daemonset, statefulset, or batch/v1beta1 cronjob.
+func getTemplateWorkload(client kubernetes.Interface, kind string, name types.NamespacedName) (runtime.Object, error) {
+	switch kind {
+	case deploymentKind:
+		return client.AppsV1().Deployments(name.Namespace).Get(name.Name, metav1.GetOptions{})
+	case daemonsetKind:
+		return client.AppsV1().DaemonSets(name.Namespace).Get(name.Name, metav1.GetOptions{})
+	case statefulsetKind:
+		return client.AppsV1().StatefulSets(name.Namespace).Get(name.Name, metav1.GetOptions{})
+	case cronjobKind:
+		return client.BatchV1beta1().CronJobs(name.Namespace).Get(name.Name, metav1.GetOptions{})
+	}
+	return nil, fmt.Errorf("%s isn't restarted through its pod template", kind)
+}
+
+// patchTemplateWorkload patches the deployment, daemonset, statefulset, or batch/v1beta1 cronjob.
+func patchTemplateWorkload(client kubernetes.Interface, kind string, name types.NamespacedName, patch []byte) error {
+	var err error
+	switch kind {
+	case deploymentKind:
+		_, err = client.AppsV1().Deployments(name.Namespace).Patch(name.Name, types.StrategicMergePatchType, patch)
+	case daemonsetKind:
+		_, err = client.AppsV1().DaemonSets(name.Namespace).Patch(name.Name, types.StrategicMergePatchType, patch)
+	case statefulsetKind:
+		_, err = client.AppsV1().StatefulSets(name.Namespace).Patch(name.Name, types.StrategicMergePatchType, patch)
+	case cronjobKind:
+		_, err = client.BatchV1beta1().CronJobs(name.Namespace).Patch(name.Name, types.StrategicMergePatchType, patch)
+	default:
+		err = fmt.Errorf("%s isn't restarted through its pod template", kind)
+	}
+	return err
+}
+
+// restartTemplate sets the config hash annotation on the pod template of a deployment, daemonset, or statefulset,
+// rolling its pods, or on the job template of a batch/v1beta1 cronjob, so the jobs it runs from then on are tied to
+// the new config while the jobs already running are left alone, unless they opt in themselves. batch/v1 cronjobs are
+// restarted through the dynamic client, see batchV1Cronjobs. Workloads that already have the hash aren't patched.
+// Patching only the annotation, rather than updating the whole object, avoids conflicting with other controllers.
+func restartTemplate(client kubernetes.Interface, kind string, workloadName types.NamespacedName, hash string) error {
+	patch, err := nestedPatch(append(templatePath(kind), "metadata", "annotations"), map[string]string{hashAnnotation: hash})
 	if err != nil {
-		klog.Errorf("Error updating deployment: %v", err)
 		return err
 	}
-	return nil
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := getTemplateWorkload(client, kind, workloadName)
+		if err != nil {
+			klog.Errorf("Error getting %s %v", kind, workloadName)
+			return err
+		}
+		if template, ok := podTemplate(obj); ok && template.Annotations[hashAnnotation] == hash {
+			klog.V(2).Infof("%s %s already has config hash %s", kind, workloadName.String(), hash)
+			return nil
+		}
+		klog.Infof("Restarting %s %s with config hash %s", kind, workloadName.String(), hash)
+		if err := patchTemplateWorkload(client, kind, workloadName, patch); err != nil {
+			klog.Errorf("Error patching %s: %v", kind, err)
+			return err
+		}
+		return nil
+	})
 }
 
-func restartDaemonset(client kubernetes.Interface, daemonsetName types.NamespacedName) error {
-	update := time.Now().Format("2006-1-2.1504")
-	klog.Infof("Restarting daemonset %s at %s", daemonsetName.String(), update)
-	daemonsetInterface := client.AppsV1().DaemonSets(daemonsetName.Namespace)
-	daemonset, err := daemonsetInterface.Get(daemonsetName.Name, metav1.GetOptions{})
+const (
+	// recreateInterval and recreateTimeout are how often, and for how long, restartJob and restartPod try to create
+	// the job or pod again while the one they deleted is going away. Pods are also given their termination grace period.
+	recreateInterval time.Duration = time.Second
+	recreateTimeout  time.Duration = 30 * time.Second
+	// jobLabelPrefix prefixes the labels generated for a job's selector, which are dropped when it's created again,
+	// as are the legacy controller-uid and job-name labels
+	jobLabelPrefix string = "batch.kubernetes.io/"
+)
+
+// restartJob deletes a running job and creates it again with the config hash on its pod template, since a job's pod
+// template can't be changed. Jobs that have finished are left alone, and running jobs aren't deleted unless recreate
+// is set. The recreated job runs from the beginning, since its pods are deleted along with the job. If the job can't
+// be created with the hash, the job that was deleted is created again as it was, also running from the beginning,
+// so it isn't lost. If even that fails, the job is gone, and a warning event is recorded against it.
+func restartJob(client kubernetes.Interface, recorder record.EventRecorder, jobName types.NamespacedName, hash string, recreate bool) error {
+	jobInterface := client.BatchV1().Jobs(jobName.Namespace)
+	job, err := jobInterface.Get(jobName.Name, metav1.GetOptions{})
 	if err != nil {
-		klog.Errorf("Error getting daemonset %v", daemonsetName)
+		klog.Errorf("Error getting job %v", jobName)
 		return err
 	}
-	daemonset.ObjectMeta.Labels[restartLabel] = update
-	daemonset.Spec.Template.ObjectMeta.Labels[restartLabel] = update
-	_, err = daemonsetInterface.Update(daemonset)
-	if err != nil {
-		klog.Errorf("Error updating daemonset: %v", err)
+	if job.Spec.Template.ObjectMeta.Annotations[hashAnnotation] == hash {
+		klog.V(2).Infof("Job %s already has config hash %s", jobName.String(), hash)
+		return nil
+	}
+	if jobFinished(job) {
+		klog.Infof("Job %s has finished, not recreating it with config hash %s", jobName.String(), hash)
+		return nil
+	}
+	if !recreate {
+		return fmt.Errorf("job %s can't be changed in place, and recreating jobs isn't enabled", jobName.String())
+	}
+
+	klog.Infof("Recreating job %s with config hash %s", jobName.String(), hash)
+	recreated := recreatedJob(job, hash)
+	propagation := metav1.DeletePropagationBackground
+	err = jobInterface.Delete(jobName.Name, &metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+		Preconditions:     &metav1.Preconditions{UID: &job.UID},
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("Error deleting job: %v", err)
 		return err
 	}
-	return nil
+	err = createJob(jobInterface, recreated)
+	if err == nil {
+		return nil
+	}
+	klog.Errorf("Error creating job %s with config hash %s, restoring it as it was: %v", jobName.String(), hash, err)
+	if restoreErr := createJob(jobInterface, copiedJob(job)); restoreErr != nil {
+		klog.Errorf("Error restoring job %s, it has to be created again by hand: %v", jobName.String(), restoreErr)
+		recorder.Eventf(job, corev1.EventTypeWarning, restoreFailedReason, "Deleted to recreate it with config hash %s, but unable to create it again, it has to be created again by hand: %v", hash, restoreErr)
+	}
+	return err
+}
+
+// createJob creates the job once the job it replaces, which keeps its name until it's gone, has been deleted.
+func createJob(jobInterface batchv1client.JobInterface, job *batchv1.Job) error {
+	return wait.PollImmediate(recreateInterval, recreateTimeout, func() (bool, error) {
+		_, err := jobInterface.Create(job)
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// jobFinished is true once the job has completed or failed.
+func jobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// recreatedJob returns the job to create in place of the given one, with the config hash on its pod template.
+func recreatedJob(job *batchv1.Job, hash string) *batchv1.Job {
+	recreated := copiedJob(job)
+	if recreated.Spec.Template.Annotations == nil {
+		recreated.Spec.Template.Annotations = make(map[string]string)
+	}
+	recreated.Spec.Template.Annotations[hashAnnotation] = hash
+	return recreated
 }
 
-func restartStatefulset(client kubernetes.Interface, statefulsetName types.NamespacedName) error {
-	update := time.Now().Format("2006-1-2.1504")
-	klog.Infof("Restarting statefulset %s at %s", statefulsetName.String(), update)
-	statefulsetInterface := client.AppsV1().StatefulSets(statefulsetName.Namespace)
-	statefulset, err := statefulsetInterface.Get(statefulsetName.Name, metav1.GetOptions{})
+// copiedJob returns a copy of the job to create it again. The selector and the labels generated for it are dropped,
+// unless the job sets its own, so they're generated again for the new job.
+func copiedJob(job *batchv1.Job) *batchv1.Job {
+	copied := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            job.Name,
+			Namespace:       job.Namespace,
+			Labels:          job.Labels,
+			Annotations:     job.Annotations,
+			OwnerReferences: job.OwnerReferences,
+		},
+		Spec: job.Spec,
+	}
+	copied = copied.DeepCopy()
+	if job.Spec.ManualSelector == nil || !*job.Spec.ManualSelector {
+		copied.Spec.Selector = nil
+		for _, labels := range []map[string]string{copied.Labels, copied.Spec.Template.Labels} {
+			for label := range labels {
+				if label == "controller-uid" || label == "job-name" || strings.HasPrefix(label, jobLabelPrefix) {
+					delete(labels, label)
+				}
+			}
+		}
+	}
+	return copied
+}
+
+// restartPod evicts the pod, through the eviction API so its PodDisruptionBudgets are respected, for its owner to
+// create it again. A pod owned by nothing is created again by the watcher once the evicted one is gone, with the
+// config hash in its annotations, and isn't evicted unless recreate is set. Pods already being deleted, and pods
+// controlled by a built-in workload, which is restarted itself, are left alone.
+func restartPod(client kubernetes.Interface, podName types.NamespacedName, hash string, recreate bool) error {
+	podInterface := client.CoreV1().Pods(podName.Namespace)
+	pod, err := podInterface.Get(podName.Name, metav1.GetOptions{})
 	if err != nil {
-		klog.Errorf("Error getting statefulset %v", statefulsetName)
+		klog.Errorf("Error getting pod %v", podName)
 		return err
 	}
-	statefulset.ObjectMeta.Labels[restartLabel] = update
-	statefulset.Spec.Template.ObjectMeta.Labels[restartLabel] = update
-	_, err = statefulsetInterface.Update(statefulset)
-	if err != nil {
-		klog.Errorf("Error updating statefulset: %v", err)
+	if pod.Annotations[hashAnnotation] == hash {
+		klog.V(2).Infof("Pod %s already has config hash %s", podName.String(), hash)
+		return nil
+	}
+	if pod.DeletionTimestamp != nil {
+		klog.Infof("Pod %s is already being deleted, not evicting it for config hash %s", podName.String(), hash)
+		return nil
+	}
+	if owner := builtInController(pod); owner != nil {
+		klog.Infof("Pod %s is restarted through its %s %s, not evicting it for config hash %s", podName.String(), owner.Kind, owner.Name, hash)
+		return nil
+	}
+	if len(pod.OwnerReferences) == 0 && !recreate {
+		return fmt.Errorf("pod %s is owned by nothing, and recreating pods isn't enabled", podName.String())
+	}
+
+	klog.Infof("Evicting pod %s for config hash %s", podName.String(), hash)
+	recreated := recreatedPod(pod, hash)
+	// A disruption budget that doesn't allow the eviction fails it with TooManyRequests, and it's retried
+	err = podInterface.Evict(&policyv1beta1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Name: podName.Name, Namespace: podName.Namespace},
+		DeleteOptions: &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &pod.UID}},
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("Error evicting pod: %v", err)
 		return err
 	}
-	return nil
+	if len(pod.OwnerReferences) > 0 {
+		return nil
+	}
+	timeout := recreateTimeout
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		timeout += time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	}
+	// The evicted pod keeps its name until it's gone
+	return wait.PollImmediate(recreateInterval, timeout, func() (bool, error) {
+		_, err := podInterface.Create(recreated)
+		if errors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		if err != nil {
+			klog.Errorf("Error creating pod %s, it has to be created again by hand: %v", podName.String(), err)
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// recreatedPod returns the pod to create in place of the given one, with the config hash in its annotations. The
+// node it was scheduled to is dropped, so it's scheduled again.
+func recreatedPod(pod *corev1.Pod, hash string) *corev1.Pod {
+	recreated := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   pod.Namespace,
+			Labels:      pod.Labels,
+			Annotations: pod.Annotations,
+		},
+		Spec: pod.Spec,
+	}
+	recreated = recreated.DeepCopy()
+	recreated.Spec.NodeName = ""
+	if recreated.Annotations == nil {
+		recreated.Annotations = make(map[string]string)
+	}
+	recreated.Annotations[hashAnnotation] = hash
+	return recreated
 }
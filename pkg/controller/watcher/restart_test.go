@@ -4,11 +4,28 @@
 package watcher
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	coretypes "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
 func TestRestartAll(t *testing.T) {
@@ -37,21 +54,665 @@ func TestRestartAll(t *testing.T) {
 	configmap.Labels = newlbl
 	simpleClient.CoreV1().ConfigMaps("default").Update(&configmap)
 
-	var watchedConfigmaps map[types.NamespacedName]*ConfigMapper = make(map[types.NamespacedName]*ConfigMapper)
+	watcher := Init(simpleClient, Options{})
 	var cnn types.NamespacedName = splitNamespacedName("default/configmap")
 
 	var cm ConfigMapper
-	cm.stopCh = nil
-	cm.Daemonsets = make(map[types.NamespacedName]uint)
-	cm.Statefulsets = make(map[types.NamespacedName]uint)
-	cm.Deployments = make(map[types.NamespacedName]uint)
-	var dnn types.NamespacedName = splitNamespacedName("default/daemonset")
-	cm.Daemonsets[dnn] = 1
-	dnn = splitNamespacedName("default/deployment")
-	cm.Deployments[dnn] = 1
-	dnn = splitNamespacedName("default/statefulset")
-	cm.Statefulsets[dnn] = 1
-	watchedConfigmaps[cnn] = &cm
-
-	RestartAll(simpleClient, cnn, watchedConfigmaps)
+	cm.track(daemonsetKind, splitNamespacedName("default/daemonset"), nil)
+	cm.track(deploymentKind, splitNamespacedName("default/deployment"), nil)
+	cm.track(statefulsetKind, splitNamespacedName("default/statefulset"), nil)
+	watcher.watchedConfigmaps[cnn] = &cm
+
+	watcher.RestartAll(configmapKind, cnn, nil)
+	drain(watcher)
+}
+
+func TestRestartAllSecret(t *testing.T) {
+
+	var simpleClient kubernetes.Interface = testclient.NewSimpleClientset()
+
+	newlbl := make(map[string]string)
+	newlbl["watcher.ibm.com/opt-in"] = "true"
+	deployment.Labels = newlbl
+
+	newannot := make(map[string]string)
+	newannot[secretAnnotation] = "default/secret"
+	deployment.Annotations = newannot
+
+	simpleClient.CoreV1().Secrets("default").Create(&secret)
+	simpleClient.AppsV1().Deployments("default").Create(&deployment)
+
+	watcher := Init(simpleClient, Options{})
+	var snn types.NamespacedName = splitNamespacedName("default/secret")
+
+	var cm ConfigMapper
+	cm.track(deploymentKind, splitNamespacedName("default/deployment"), nil)
+	watcher.watchedSecrets[snn] = &cm
+
+	watcher.RestartAll(secretKind, snn, nil)
+	drain(watcher)
+
+	restarted, err := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, restarted.Spec.Template.Annotations[hashAnnotation])
+}
+
+func TestRestartAllKeys(t *testing.T) {
+
+	var simpleClient kubernetes.Interface = testclient.NewSimpleClientset()
+
+	newlbl := make(map[string]string)
+	newlbl["watcher.ibm.com/opt-in"] = "true"
+	deployment.Labels = newlbl
+	daemonset.Labels = newlbl
+
+	simpleClient.AppsV1().Deployments("default").Create(&deployment)
+	simpleClient.AppsV1().DaemonSets("default").Create(&daemonset)
+
+	watcher := Init(simpleClient, Options{})
+	var cnn types.NamespacedName = splitNamespacedName("default/configmap")
+
+	// The deployment only reads logging.yaml while the daemonset reads every key
+	var cm ConfigMapper
+	cm.track(deploymentKind, splitNamespacedName("default/deployment"), keyFilter{"logging.yaml": {}})
+	cm.track(daemonsetKind, splitNamespacedName("default/daemonset"), nil)
+	watcher.watchedConfigmaps[cnn] = &cm
+
+	watcher.RestartAll(configmapKind, cnn, map[string]struct{}{"app.yaml": {}})
+	drain(watcher)
+
+	restartedDeployment, err := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, restartedDeployment.Spec.Template.Annotations[hashAnnotation])
+	restartedDaemonset, err := simpleClient.AppsV1().DaemonSets("default").Get("daemonset", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, restartedDaemonset.Spec.Template.Annotations[hashAnnotation])
+
+	watcher.RestartAll(configmapKind, cnn, map[string]struct{}{"logging.yaml": {}})
+	drain(watcher)
+
+	restartedDeployment, err = simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, restartedDeployment.Spec.Template.Annotations[hashAnnotation])
+}
+
+func TestConfigHash(t *testing.T) {
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	watcher.configmapStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	watcher.secretStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	key := workload{kind: deploymentKind, name: splitNamespacedName("default/hashed")}
+	watcher.watchedWorkloads[key] = &references{
+		configmaps:    []types.NamespacedName{splitNamespacedName("default/hashed")},
+		configmapKeys: keyFilter{"app.yaml": {}},
+		secrets:       []types.NamespacedName{splitNamespacedName("default/hashed")},
+	}
+
+	hashedConfigmap := &coretypes.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "hashed", Namespace: "default"},
+		Data:       map[string]string{"app.yaml": "v1", "other.yaml": "v1"},
+	}
+	hashedSecret := &coretypes.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "hashed", Namespace: "default"},
+		Data:       map[string][]byte{"tls.crt": []byte("v1")},
+	}
+	watcher.configmapStores[""].Add(hashedConfigmap)
+	watcher.secretStores[""].Add(hashedSecret)
+	original := watcher.configHash(key)
+	assert.Len(t, original, 64)
+	assert.Equal(t, original, watcher.configHash(key))
+
+	// Keys the workload doesn't subscribe to don't change the hash
+	changed := hashedConfigmap.DeepCopy()
+	changed.Data["other.yaml"] = "v2"
+	watcher.configmapStores[""].Update(changed)
+	assert.Equal(t, original, watcher.configHash(key))
+
+	changed.Data["app.yaml"] = "v2"
+	watcher.configmapStores[""].Update(changed)
+	updated := watcher.configHash(key)
+	assert.NotEqual(t, original, updated)
+
+	changedSecret := hashedSecret.DeepCopy()
+	changedSecret.Data["tls.crt"] = []byte("v2")
+	watcher.secretStores[""].Update(changedSecret)
+	assert.NotEqual(t, updated, watcher.configHash(key))
+
+	// Reverting to the original data gives back the original hash
+	watcher.configmapStores[""].Update(hashedConfigmap)
+	watcher.secretStores[""].Update(hashedSecret)
+	assert.Equal(t, original, watcher.configHash(key))
+}
+
+func TestRestartDeploymentHash(t *testing.T) {
+	var simpleClient = testclient.NewSimpleClientset()
+	simpleClient.AppsV1().Deployments("default").Create(&deployment)
+	name := splitNamespacedName("default/deployment")
+
+	// Two different hashes in a row both roll the deployment
+	assert.Nil(t, restartTemplate(simpleClient, deploymentKind, name, "first"))
+	assert.Nil(t, restartTemplate(simpleClient, deploymentKind, name, "second"))
+	restarted, err := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "second", restarted.Spec.Template.Annotations[hashAnnotation])
+
+	// The same hash again doesn't patch the deployment
+	simpleClient.ClearActions()
+	assert.Nil(t, restartTemplate(simpleClient, deploymentKind, name, "second"))
+	for _, action := range simpleClient.Actions() {
+		assert.NotEqual(t, "patch", action.GetVerb())
+	}
+}
+
+func TestRestartCronjob(t *testing.T) {
+	cronjob := &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "cronjob", Namespace: "default"}}
+	simpleClient := testclient.NewSimpleClientset(cronjob)
+	name := splitNamespacedName("default/cronjob")
+
+	// The hash goes on the pod template of the job template
+	assert.Nil(t, restartTemplate(simpleClient, cronjobKind, name, "first"))
+	restarted, err := simpleClient.BatchV1beta1().CronJobs("default").Get("cronjob", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "first", restarted.Spec.JobTemplate.Spec.Template.Annotations[hashAnnotation])
+
+	simpleClient.ClearActions()
+	assert.Nil(t, restartTemplate(simpleClient, cronjobKind, name, "first"))
+	for _, action := range simpleClient.Actions() {
+		assert.NotEqual(t, "patch", action.GetVerb())
+	}
+}
+
+func TestRestartJob(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	// The labels generated for the selector, before and since they're prefixed
+	for _, generated := range []map[string]string{
+		{"controller-uid": "uid", "job-name": "job", "app": "batch"},
+		{"batch.kubernetes.io/controller-uid": "uid", "batch.kubernetes.io/job-name": "job", "controller-uid": "uid", "job-name": "job", "app": "batch"},
+	} {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "default", UID: "uid", Labels: generated},
+			Spec: batchv1.JobSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "uid"}},
+				Template: coretypes.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: generated}},
+			},
+		}
+		simpleClient := testclient.NewSimpleClientset(job)
+
+		// A running job is recreated with the hash, and without the generated selector and labels
+		assert.Nil(t, restartJob(simpleClient, recorder, splitNamespacedName("default/job"), "first", true))
+		verbs := []string{}
+		for _, action := range simpleClient.Actions() {
+			verbs = append(verbs, action.GetVerb())
+		}
+		assert.Equal(t, []string{"get", "delete", "create"}, verbs)
+		recreated, err := simpleClient.BatchV1().Jobs("default").Get("job", metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, "first", recreated.Spec.Template.Annotations[hashAnnotation])
+		assert.Nil(t, recreated.Spec.Selector)
+		assert.Equal(t, map[string]string{"app": "batch"}, recreated.Labels)
+		assert.Equal(t, map[string]string{"app": "batch"}, recreated.Spec.Template.Labels)
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "default", UID: "uid", Labels: map[string]string{"app": "batch"}},
+	}
+	finished := job.DeepCopy()
+	finished.Name = "finished"
+	finished.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: coretypes.ConditionTrue}}
+	simpleClient := testclient.NewSimpleClientset(job, finished)
+	assert.Nil(t, restartJob(simpleClient, recorder, splitNamespacedName("default/job"), "first", true))
+
+	// The same hash again leaves it alone, as does a job that has finished
+	simpleClient.ClearActions()
+	assert.Nil(t, restartJob(simpleClient, recorder, splitNamespacedName("default/job"), "first", true))
+	assert.Nil(t, restartJob(simpleClient, recorder, splitNamespacedName("default/finished"), "first", true))
+	for _, action := range simpleClient.Actions() {
+		assert.Equal(t, "get", action.GetVerb())
+	}
+	assert.True(t, errors.IsNotFound(restartJob(simpleClient, recorder, splitNamespacedName("default/missing"), "first", true)))
+
+	// A running job isn't deleted unless recreating jobs is enabled
+	simpleClient.ClearActions()
+	assert.NotNil(t, restartJob(simpleClient, recorder, splitNamespacedName("default/job"), "second", false))
+	for _, action := range simpleClient.Actions() {
+		assert.Equal(t, "get", action.GetVerb())
+	}
+
+	// A job that can't be created with the hash is restored as it was
+	rejected := true
+	simpleClient.PrependReactor("create", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		created := action.(clienttesting.CreateAction).GetObject().(*batchv1.Job)
+		if rejected && created.Spec.Template.Annotations[hashAnnotation] == "second" {
+			rejected = false
+			return true, nil, errors.NewForbidden(schema.GroupResource{Group: "batch", Resource: "jobs"}, created.Name, nil)
+		}
+		return false, nil, nil
+	})
+	assert.True(t, errors.IsForbidden(restartJob(simpleClient, recorder, splitNamespacedName("default/job"), "second", true)))
+	restored, err := simpleClient.BatchV1().Jobs("default").Get("job", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "first", restored.Spec.Template.Annotations[hashAnnotation])
+	assert.Empty(t, recorder.Events)
+
+	// A job that can't be restored either is gone, with a warning event recorded against it
+	simpleClient.PrependReactor("create", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		created := action.(clienttesting.CreateAction).GetObject().(*batchv1.Job)
+		return true, nil, errors.NewForbidden(schema.GroupResource{Group: "batch", Resource: "jobs"}, created.Name, nil)
+	})
+	assert.True(t, errors.IsForbidden(restartJob(simpleClient, recorder, splitNamespacedName("default/job"), "third", true)))
+	_, err = simpleClient.BatchV1().Jobs("default").Get("job", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning "+restoreFailedReason)
+}
+
+func TestRestartPod(t *testing.T) {
+	bare := &coretypes.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "bare", Namespace: "default", UID: "uid"},
+		Spec:       coretypes.PodSpec{NodeName: "node"},
+	}
+	owned := bare.DeepCopy()
+	owned.Name = "owned"
+	owned.OwnerReferences = []metav1.OwnerReference{{Kind: "Workload", Name: "owner"}}
+	controller := true
+	replicated := bare.DeepCopy()
+	replicated.Name = "replicated"
+	replicated.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app", Controller: &controller}}
+	simpleClient := testclient.NewSimpleClientset(bare, owned, replicated)
+	// The eviction deletes the pod, unless a disruption budget doesn't allow it
+	budget := true
+	simpleClient.PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		if !budget {
+			return true, nil, errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0)
+		}
+		eviction := action.(clienttesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+		return true, nil, simpleClient.Tracker().Delete(action.GetResource(), eviction.Namespace, eviction.Name)
+	})
+
+	// A pod owned by nothing is only evicted when it can be created again
+	assert.NotNil(t, restartPod(simpleClient, splitNamespacedName("default/bare"), "first", false))
+	_, err := simpleClient.CoreV1().Pods("default").Get("bare", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// Then it's evicted and created again with the hash, on any node
+	assert.Nil(t, restartPod(simpleClient, splitNamespacedName("default/bare"), "first", true))
+	recreated, err := simpleClient.CoreV1().Pods("default").Get("bare", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "first", recreated.Annotations[hashAnnotation])
+	assert.Empty(t, recreated.Spec.NodeName)
+
+	// An owned pod is only evicted, for its owner to create it again
+	assert.Nil(t, restartPod(simpleClient, splitNamespacedName("default/owned"), "first", true))
+	_, err = simpleClient.CoreV1().Pods("default").Get("owned", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// A pod controlled by a built-in workload is left for the workload to restart
+	assert.Nil(t, restartPod(simpleClient, splitNamespacedName("default/replicated"), "first", true))
+	_, err = simpleClient.CoreV1().Pods("default").Get("replicated", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	// The same hash again leaves it alone, and an eviction the disruption budget doesn't allow is returned
+	simpleClient.ClearActions()
+	assert.Nil(t, restartPod(simpleClient, splitNamespacedName("default/bare"), "first", true))
+	assert.Len(t, simpleClient.Actions(), 1)
+	budget = false
+	assert.True(t, errors.IsTooManyRequests(restartPod(simpleClient, splitNamespacedName("default/bare"), "second", true)))
+	_, err = simpleClient.CoreV1().Pods("default").Get("bare", metav1.GetOptions{})
+	assert.Nil(t, err)
+}
+
+func TestRestartConflict(t *testing.T) {
+	var simpleClient = testclient.NewSimpleClientset()
+	simpleClient.AppsV1().Deployments("default").Create(&deployment)
+	simpleClient.AppsV1().DaemonSets("default").Create(&daemonset)
+	simpleClient.AppsV1().StatefulSets("default").Create(&statefulset)
+
+	// Every patch conflicts twice before going through, as if another controller got there first
+	conflicts := 0
+	simpleClient.PrependReactor("patch", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if conflicts%3 < 2 {
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Group: "apps", Resource: action.GetResource().Resource}, "", nil)
+		}
+		conflicts++
+		return false, nil, nil
+	})
+
+	assert.Nil(t, restartTemplate(simpleClient, deploymentKind, splitNamespacedName("default/deployment"), "hash"))
+	assert.Nil(t, restartTemplate(simpleClient, daemonsetKind, splitNamespacedName("default/daemonset"), "hash"))
+	assert.Nil(t, restartTemplate(simpleClient, statefulsetKind, splitNamespacedName("default/statefulset"), "hash"))
+	assert.Equal(t, 9, conflicts)
+
+	restartedDeployment, err := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", restartedDeployment.Spec.Template.Annotations[hashAnnotation])
+	restartedDaemonset, err := simpleClient.AppsV1().DaemonSets("default").Get("daemonset", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", restartedDaemonset.Spec.Template.Annotations[hashAnnotation])
+	restartedStatefulset, err := simpleClient.AppsV1().StatefulSets("default").Get("statefulset", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", restartedStatefulset.Spec.Template.Annotations[hashAnnotation])
+
+	// A conflict that never clears is returned once the retries run out
+	simpleClient.PrependReactor("patch", "deployments", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, "deployment", nil)
+	})
+	err = restartTemplate(simpleClient, deploymentKind, splitNamespacedName("default/deployment"), "other")
+	assert.True(t, errors.IsConflict(err))
+}
+
+func TestRestartWithoutLabelsOrAnnotations(t *testing.T) {
+	var simpleClient = testclient.NewSimpleClientset()
+	simpleClient.AppsV1().Deployments("default").Create(&v1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "bare", Namespace: "default"}})
+	simpleClient.AppsV1().DaemonSets("default").Create(&v1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "bare", Namespace: "default"}})
+	simpleClient.AppsV1().StatefulSets("default").Create(&v1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "bare", Namespace: "default"}})
+
+	name := splitNamespacedName("default/bare")
+	assert.Nil(t, restartTemplate(simpleClient, deploymentKind, name, "hash"))
+	assert.Nil(t, restartTemplate(simpleClient, daemonsetKind, name, "hash"))
+	assert.Nil(t, restartTemplate(simpleClient, statefulsetKind, name, "hash"))
+
+	restarted, err := simpleClient.AppsV1().Deployments("default").Get("bare", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", restarted.Spec.Template.Annotations[hashAnnotation])
+}
+
+func TestRestartAllFailures(t *testing.T) {
+	var simpleClient = testclient.NewSimpleClientset()
+	simpleClient.AppsV1().Deployments("default").Create(&deployment)
+
+	watcher := Init(simpleClient, Options{})
+	defer watcher.queue.ShutDown()
+	var cnn types.NamespacedName = splitNamespacedName("default/configmap")
+	var cm ConfigMapper
+	cm.track(deploymentKind, splitNamespacedName("default/deployment"), nil)
+	cm.track(daemonsetKind, splitNamespacedName("default/missing"), nil)
+	cm.track(statefulsetKind, splitNamespacedName("default/missing"), nil)
+	watcher.watchedConfigmaps[cnn] = &cm
+
+	attempted := testutil.ToFloat64(restartsAttempted.WithLabelValues(daemonsetKind, "default"))
+	succeeded := testutil.ToFloat64(restartsSucceeded.WithLabelValues(deploymentKind, "default"))
+	failed := testutil.ToFloat64(restartsFailed.WithLabelValues(daemonsetKind, "default"))
+	retried := testutil.ToFloat64(restartsRetried.WithLabelValues(daemonsetKind, "default"))
+
+	// The missing workloads fail without stopping the deployment from restarting, and are queued to be retried
+	recorder := record.NewFakeRecorder(10)
+	watcher.recorder = recorder
+	watcher.RestartAll(configmapKind, cnn, nil)
+	drain(watcher)
+	assert.Equal(t, uint64(2), watcher.Failures())
+	assert.Equal(t, 1, watcher.queue.NumRequeues(workload{kind: daemonsetKind, name: splitNamespacedName("default/missing")}))
+	assert.Equal(t, 1, watcher.queue.NumRequeues(workload{kind: statefulsetKind, name: splitNamespacedName("default/missing")}))
+	assert.Equal(t, 0, watcher.queue.NumRequeues(workload{kind: deploymentKind, name: splitNamespacedName("default/deployment")}))
+	assert.Equal(t, retried+1, testutil.ToFloat64(restartsRetried.WithLabelValues(daemonsetKind, "default")))
+	assert.Equal(t, attempted+1, testutil.ToFloat64(restartsAttempted.WithLabelValues(daemonsetKind, "default")))
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(restartsSucceeded.WithLabelValues(deploymentKind, "default")))
+	assert.Equal(t, failed+1, testutil.ToFloat64(restartsFailed.WithLabelValues(daemonsetKind, "default")))
+
+	// Each restart is recorded against both the configmap and the workload
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.Len(t, events, 6)
+	assert.Contains(t, events, "Normal Restarted Restarted deployment default/deployment due to change in configmap default/configmap")
+	assert.Contains(t, events, "Normal Restarted Restarted due to change in configmap default/configmap")
+	assert.Contains(t, strings.Join(events, "\n"), "Warning RestartFailed Unable to restart daemonset default/missing")
+	assert.Contains(t, strings.Join(events, "\n"), "Warning RestartFailed Unable to restart due to change in configmap default/configmap")
+
+	restarted, getErr := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, getErr)
+	assert.NotEmpty(t, restarted.Spec.Template.Annotations[hashAnnotation])
+
+	// Nothing watching the configmap queues nothing
+	watcher.RestartAll(configmapKind, splitNamespacedName("default/unwatched"), nil)
+	assert.Equal(t, 0, watcher.queue.Len())
+}
+
+func TestHandlersIgnoreUnexpectedObjects(t *testing.T) {
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	assert.NotPanics(t, func() {
+		watcher.configmapHandler().OnUpdate("old", "new")
+		watcher.secretHandler().OnUpdate(nil, nil)
+		watcher.workloadHandler(deploymentKind).OnAdd("not a deployment")
+		watcher.workloadHandler(deploymentKind).OnDelete(cache.DeletedFinalStateUnknown{Key: "default/gone"})
+	})
+}
+
+func TestRestartAllDryRun(t *testing.T) {
+	var simpleClient = testclient.NewSimpleClientset()
+	deployment.Spec.Template.Annotations = nil
+	simpleClient.AppsV1().Deployments("default").Create(&deployment)
+
+	var cnn types.NamespacedName = splitNamespacedName("default/configmap")
+	var name types.NamespacedName = splitNamespacedName("default/deployment")
+	var cm ConfigMapper
+	cm.track(deploymentKind, name, nil)
+
+	notRestarted := func() {
+		unchanged, err := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Empty(t, unchanged.Spec.Template.Annotations[hashAnnotation])
+	}
+
+	// The dry-run option skips every restart
+	watcher := Init(simpleClient, Options{DryRun: true})
+	watcher.watchedConfigmaps[cnn] = &cm
+	recorder := record.NewFakeRecorder(10)
+	watcher.recorder = recorder
+	watcher.RestartAll(configmapKind, cnn, nil)
+	drain(watcher)
+	notRestarted()
+	assert.Equal(t, "Normal DryRunRestart Would restart deployment default/deployment due to change in configmap default/configmap, skipped in dry run", <-recorder.Events)
+	assert.Equal(t, "Normal DryRunRestart Would restart due to change in configmap default/configmap, skipped in dry run", <-recorder.Events)
+
+	// So does the workload's dry-run annotation
+	key := workload{kind: deploymentKind, name: name}
+	watcher = Init(simpleClient, Options{})
+	watcher.watchedConfigmaps[cnn] = &cm
+	watcher.watchedWorkloads[key] = watcher.resolveAnnotations(deploymentKind, name, map[string]string{dryRunAnnotation: "true"})
+	watcher.RestartAll(configmapKind, cnn, nil)
+	drain(watcher)
+	notRestarted()
+
+	// A value that can't be parsed leaves the workload in dry run
+	for _, test := range []struct {
+		value  string
+		dryRun bool
+	}{
+		{"true", true},
+		{"1", true},
+		{"yes", true},
+		{"", true},
+		{"false", false},
+		{"0", false},
+	} {
+		assert.Equal(t, test.dryRun, watcher.resolveAnnotations(deploymentKind, name, map[string]string{dryRunAnnotation: test.value}).dryRun, test.value)
+	}
+	watcher.watchedWorkloads[key] = watcher.resolveAnnotations(deploymentKind, name, map[string]string{dryRunAnnotation: "yes"})
+	watcher.RestartAll(configmapKind, cnn, nil)
+	drain(watcher)
+	notRestarted()
+
+	watcher.watchedWorkloads[key] = watcher.resolveAnnotations(deploymentKind, name, map[string]string{dryRunAnnotation: "false"})
+	watcher.RestartAll(configmapKind, cnn, nil)
+	drain(watcher)
+	restarted, err := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, restarted.Spec.Template.Annotations[hashAnnotation])
+}
+
+func TestRestartAllDebounce(t *testing.T) {
+	var simpleClient = testclient.NewSimpleClientset()
+	simpleClient.AppsV1().Deployments("default").Create(&deployment)
+
+	var cnn types.NamespacedName = splitNamespacedName("default/configmap")
+	var name types.NamespacedName = splitNamespacedName("default/deployment")
+	key := workload{kind: deploymentKind, name: name}
+	var cm ConfigMapper
+	cm.track(deploymentKind, name, nil)
+
+	// Every restart starts with getting the deployment
+	restarts := func() int {
+		count := 0
+		for _, action := range simpleClient.Actions() {
+			if action.GetVerb() == "get" {
+				count++
+			}
+		}
+		return count
+	}
+	update := func(watcher *WatcherController) {
+		watcher.watchedLock.Lock()
+		defer watcher.watchedLock.Unlock()
+		watcher.RestartAll(configmapKind, cnn, nil)
+	}
+	pending := func(watcher *WatcherController) int {
+		watcher.watchedLock.Lock()
+		defer watcher.watchedLock.Unlock()
+		return len(watcher.pending)
+	}
+
+	// A burst of updates restarts the deployment once, after it has settled
+	watcher := Init(simpleClient, Options{Debounce: 100 * time.Millisecond})
+	watcher.watchedConfigmaps[cnn] = &cm
+	for i := 0; i < 3; i++ {
+		update(watcher)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 0, watcher.queue.Len())
+	for i := 0; i < 50 && watcher.queue.Len() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, watcher.queue.Len())
+	drain(watcher)
+	assert.Equal(t, 1, restarts())
+	assert.Equal(t, 0, pending(watcher))
+
+	// The workload's annotation overrides the option, a zero period restarting it right away
+	watcher.watchedWorkloads[key] = watcher.resolveAnnotations(deploymentKind, name, map[string]string{debounceAnnotation: "0s"})
+	update(watcher)
+	drain(watcher)
+	assert.Equal(t, 2, restarts())
+	watcher.watchedWorkloads[key] = watcher.resolveAnnotations(deploymentKind, name, map[string]string{debounceAnnotation: "soon"})
+	assert.Nil(t, watcher.watchedWorkloads[key].debounce)
+
+	// Pending restarts are performed when the watcher stops
+	watcher = Init(simpleClient, Options{Debounce: time.Hour})
+	watcher.watchedConfigmaps[cnn] = &cm
+	update(watcher)
+	assert.Equal(t, 1, pending(watcher))
+	watcher.flushPending()
+	drain(watcher)
+	assert.Equal(t, 3, restarts())
+	assert.Equal(t, 0, pending(watcher))
+
+	// And dropped once the workload is no longer watched
+	update(watcher)
+	assert.Equal(t, 1, pending(watcher))
+	watcher.register(key, annotationSource, nil)
+	assert.Equal(t, 0, pending(watcher))
+	assert.Equal(t, 3, restarts())
+}
+
+func TestProcessNextRestart(t *testing.T) {
+	var simpleClient = testclient.NewSimpleClientset()
+	watcher := Init(simpleClient, Options{})
+	// Retried without waiting
+	watcher.queue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond))
+	defer watcher.queue.ShutDown()
+	var cnn types.NamespacedName = splitNamespacedName("default/configmap")
+	missing := workload{kind: deploymentKind, name: splitNamespacedName("default/missing")}
+
+	// A restart that keeps failing is retried, then dropped
+	watcher.watchedLock.Lock()
+	watcher.enqueue(configmapKind, cnn, missing)
+	watcher.watchedLock.Unlock()
+	for i := 0; i <= maxRestartRetries; i++ {
+		assert.True(t, watcher.processNextRestart())
+	}
+	assert.Equal(t, uint64(maxRestartRetries+1), watcher.Failures())
+	assert.Equal(t, 0, watcher.queue.NumRequeues(missing))
+	assert.Empty(t, watcher.changes)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, watcher.queue.Len())
+
+	// A workload forgotten while it's queued is skipped
+	watcher.watchedLock.Lock()
+	watcher.enqueue(configmapKind, cnn, missing)
+	watcher.watchedLock.Unlock()
+	watcher.register(missing, annotationSource, nil)
+	assert.True(t, watcher.processNextRestart())
+	assert.Equal(t, uint64(maxRestartRetries+1), watcher.Failures())
+
+	// A change recorded while the last retry is in flight isn't dropped with it
+	attempts := 0
+	newer := splitNamespacedName("default/newer")
+	simpleClient.PrependReactor("get", "deployments", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if attempts++; attempts == maxRestartRetries+1 {
+			watcher.watchedLock.Lock()
+			watcher.enqueue(configmapKind, newer, missing)
+			watcher.watchedLock.Unlock()
+		}
+		return false, nil, nil
+	})
+	watcher.watchedLock.Lock()
+	watcher.enqueue(configmapKind, cnn, missing)
+	watcher.watchedLock.Unlock()
+	for i := 0; i <= maxRestartRetries; i++ {
+		assert.True(t, watcher.processNextRestart())
+	}
+	assert.Equal(t, newer, watcher.changes[missing].resource)
+	assert.Equal(t, 1, watcher.queue.Len())
+
+	// The workers stop once the queue is shut down and drained
+	watcher.queue.ShutDown()
+	assert.True(t, watcher.processNextRestart())
+	assert.False(t, watcher.processNextRestart())
+}
+
+func TestThrottle(t *testing.T) {
+	assert.Nil(t, newThrottle(0))
+	throttle := newThrottle(60)
+	assert.True(t, throttle.Allow())
+	assert.False(t, throttle.Allow())
+
+	// A restart waiting on the cap is performed once the cap allows it
+	name := splitNamespacedName("default/app")
+	key := workload{kind: deploymentKind, name: name}
+	simpleClient := testclient.NewSimpleClientset(&v1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}})
+	watcher := Init(simpleClient, Options{RestartsPerMinute: 600})
+	assert.True(t, watcher.throttle.Allow())
+	watcher.watchedLock.Lock()
+	watcher.enqueue(configmapKind, splitNamespacedName("default/config"), key)
+	watcher.watchedLock.Unlock()
+	assert.Nil(t, watcher.restart(key))
+	deployment, err := simpleClient.AppsV1().Deployments(name.Namespace).Get(name.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, deployment.Spec.Template.Annotations[hashAnnotation])
+
+	// And dropped only once the shutdown grace period runs out
+	simpleClient = testclient.NewSimpleClientset(&v1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}})
+	watcher = Init(simpleClient, Options{RestartsPerMinute: 1})
+	assert.True(t, watcher.throttle.Allow())
+	watcher.watchedLock.Lock()
+	watcher.enqueue(configmapKind, splitNamespacedName("default/config"), key)
+	watcher.watchedLock.Unlock()
+	time.AfterFunc(100*time.Millisecond, watcher.stop)
+	assert.Nil(t, watcher.restart(key))
+	deployment, err = simpleClient.AppsV1().Deployments(name.Namespace).Get(name.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, deployment.Spec.Template.Annotations[hashAnnotation])
+}
+
+// drain performs the queued restarts, as the workers would.
+func drain(w *WatcherController) {
+	for w.queue.Len() > 0 {
+		w.processNextRestart()
+	}
 }
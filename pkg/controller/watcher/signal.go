@@ -0,0 +1,215 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog"
+)
+
+const (
+	// rolloutStrategy and signalStrategy are the values of the strategy annotation, rolling the workload's pods or
+	// sending them a signal to reload their config in place
+	rolloutStrategy string = "rollout"
+	signalStrategy  string = "signal"
+	// defaultSignal is sent when the workload doesn't set the signal annotation
+	defaultSignal string = "HUP"
+)
+
+// signals are the signals a workload may be reloaded with, by the names kill takes.
+var signals = map[string]struct{}{
+	"HUP": {}, "INT": {}, "QUIT": {}, "USR1": {}, "USR2": {}, "TERM": {}, "WINCH": {}, "ALRM": {},
+}
+
+// reloadSignal is the signal the pods of a workload with the signal strategy are sent, and the container it's sent
+// in, the pod's first container if empty.
+type reloadSignal struct {
+	name      string
+	container string
+}
+
+// podExecutor runs the command in the container of the pod.
+type podExecutor func(pod types.NamespacedName, container string, command []string) error
+
+// parseStrategy returns the signal a workload with the signal strategy is reloaded with, from its signal and
+// signal-container annotations, or nil for the rollout strategy. Values that can't be parsed are logged, and the
+// workload is rolled out as it is without the annotation.
+func parseStrategy(kind string, workloadName types.NamespacedName, value string, annotations map[string]string) *reloadSignal {
+	switch value {
+	case rolloutStrategy:
+		return nil
+	case signalStrategy:
+	default:
+		klog.Errorf("Unable to parse the %s annotation on %s %s: %q isn't %s or %s", strategyAnnotation, kind, workloadName, value, rolloutStrategy, signalStrategy)
+		return nil
+	}
+	signal := &reloadSignal{name: defaultSignal, container: annotations[signalContainer]}
+	if value, ok := annotations[signalAnnotation]; ok {
+		signal.name = strings.TrimPrefix(strings.ToUpper(value), "SIG")
+		if _, ok := signals[signal.name]; !ok {
+			klog.Errorf("Unable to parse the %s annotation on %s %s: %q isn't a signal it may be reloaded with", signalAnnotation, kind, workloadName, value)
+			return nil
+		}
+	}
+	return signal
+}
+
+// newPodExecutor returns the podExecutor running commands through the pods/exec subresource.
+func newPodExecutor(client kubernetes.Interface, config *rest.Config) podExecutor {
+	return func(pod types.NamespacedName, container string, command []string) error {
+		req := client.CoreV1().RESTClient().Post().
+			Resource("pods").Namespace(pod.Namespace).Name(pod.Name).SubResource("exec").
+			VersionedParams(&corev1.PodExecOptions{Container: container, Command: command, Stdout: true, Stderr: true}, scheme.ParameterCodec)
+		executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+		if err != nil {
+			return err
+		}
+		var stdout, stderr bytes.Buffer
+		if err := executor.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr}); err != nil {
+			if output := strings.TrimSpace(stderr.String()); output != "" {
+				return fmt.Errorf("%v: %s", err, output)
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// signalPods sends the signal to the main process of the container in each running pod of the workload, through the
+// pods/exec subresource, so they reload their config without being restarted. The pods are found by the workload's
+// selector, and only those it controls, directly or through its replicasets or jobs, are signaled, or by name for an
+// opted-in pod. Each pod signaled is annotated with the config hash, and pods that already have it are skipped, so a
+// failure on one pod retries only the pods that weren't signaled.
+func (w *WatcherController) signalPods(key workload, signal *reloadSignal, podSelector *metav1.LabelSelector, uid types.UID, hash string) error {
+	if w.exec == nil {
+		return errors.New("signaling pods isn't enabled, there's no REST config to exec into them with")
+	}
+	podInterface := w.client.CoreV1().Pods(key.name.Namespace)
+	var pods []corev1.Pod
+	if key.kind == podKind {
+		pod, err := podInterface.Get(key.name.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("Error getting pod %v", key.name)
+			return err
+		}
+		pods = append(pods, *pod)
+	} else {
+		selector, err := metav1.LabelSelectorAsSelector(podSelector)
+		if err != nil {
+			return fmt.Errorf("unable to parse the selector of %s %s: %v", key.kind, key.name.String(), err)
+		}
+		// An empty selector would match every pod in the namespace
+		if selector.Empty() || uid == "" {
+			return errors.New("no selector on the workload to find the pods to signal by")
+		}
+		list, err := podInterface.List(metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			klog.Errorf("Error listing the pods of %s %v", key.kind, key.name)
+			return err
+		}
+		owners := map[types.UID]types.UID{}
+		for _, pod := range list.Items {
+			controlled, err := w.controlledBy(&pod, uid, owners)
+			if err != nil {
+				klog.Errorf("Error getting the controller of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+				return err
+			}
+			if !controlled {
+				klog.V(2).Infof("Not signaling pod %s/%s, which %s %s doesn't control", pod.Namespace, pod.Name, key.kind, key.name.String())
+				continue
+			}
+			pods = append(pods, pod)
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{hashAnnotation: hash},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, pod := range pods {
+		podName := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			klog.V(3).Infof("Not signaling pod %s, which isn't running", podName.String())
+			continue
+		}
+		if pod.Annotations[hashAnnotation] == hash {
+			klog.V(2).Infof("Pod %s already has config hash %s", podName.String(), hash)
+			continue
+		}
+		container := signal.container
+		if container == "" && len(pod.Spec.Containers) > 0 {
+			container = pod.Spec.Containers[0].Name
+		}
+		klog.Infof("Sending SIG%s to container %s of pod %s for config hash %s", signal.name, container, podName.String(), hash)
+		if err := w.exec(podName, container, []string{"kill", "-s", signal.name, "1"}); err != nil {
+			klog.Errorf("Error signaling pod %s: %v", podName.String(), err)
+			errs = append(errs, fmt.Errorf("pod %s: %v", pod.Name, err))
+			continue
+		}
+		if _, err := podInterface.Patch(pod.Name, types.MergePatchType, patch); err != nil {
+			klog.Errorf("Error patching pod %s: %v", podName.String(), err)
+			errs = append(errs, fmt.Errorf("pod %s: %v", pod.Name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// controlledBy returns whether the pod is controlled by the workload with the uid, either directly or through the
+// replicaset or job controlling it. The controllers of the replicasets and jobs looked up are kept in owners, by uid.
+func (w *WatcherController) controlledBy(pod *corev1.Pod, uid types.UID, owners map[types.UID]types.UID) (bool, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return false, nil
+	}
+	if owner.UID == uid {
+		return true, nil
+	}
+	controller, ok := owners[owner.UID]
+	if !ok {
+		gv, err := schema.ParseGroupVersion(owner.APIVersion)
+		if err != nil {
+			return false, nil
+		}
+		var object metav1.Object
+		switch gv.WithKind(owner.Kind).GroupKind() {
+		case schema.GroupKind{Group: "apps", Kind: "ReplicaSet"}:
+			object, err = w.client.AppsV1().ReplicaSets(pod.Namespace).Get(owner.Name, metav1.GetOptions{})
+		case schema.GroupKind{Group: "batch", Kind: "Job"}:
+			object, err = w.client.BatchV1().Jobs(pod.Namespace).Get(owner.Name, metav1.GetOptions{})
+		default:
+			return false, nil
+		}
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if object.GetUID() == owner.UID {
+			if ref := metav1.GetControllerOf(object); ref != nil {
+				controller = ref.UID
+			}
+		}
+		owners[owner.UID] = controller
+	}
+	return controller != "" && controller == uid, nil
+}
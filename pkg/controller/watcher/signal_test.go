@@ -0,0 +1,124 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseStrategy(t *testing.T) {
+	name := splitNamespacedName("default/app")
+	tests := []struct {
+		annotations map[string]string
+		signal      *reloadSignal
+	}{
+		{map[string]string{strategyAnnotation: rolloutStrategy}, nil},
+		{map[string]string{strategyAnnotation: "reload"}, nil},
+		{map[string]string{strategyAnnotation: signalStrategy}, &reloadSignal{name: "HUP"}},
+		{map[string]string{strategyAnnotation: signalStrategy, signalAnnotation: "SIGUSR1", signalContainer: "nginx"},
+			&reloadSignal{name: "USR1", container: "nginx"}},
+		{map[string]string{strategyAnnotation: signalStrategy, signalAnnotation: "term"}, &reloadSignal{name: "TERM"}},
+		{map[string]string{strategyAnnotation: signalStrategy, signalAnnotation: "SIGKILL"}, nil},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.signal, parseStrategy(deploymentKind, name, test.annotations[strategyAnnotation], test.annotations), test.annotations)
+	}
+}
+
+func TestSignalPods(t *testing.T) {
+	app := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "default",
+			UID:       "app-uid",
+			Annotations: map[string]string{
+				watcherAnnotation:  "default/config",
+				strategyAnnotation: signalStrategy,
+				signalContainer:    "nginx",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web", "track": "stable"}},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web", "track": "stable"}}},
+		},
+	}
+	controller := func(kind, name string, uid types.UID) []metav1.OwnerReference {
+		isController := true
+		return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: name, UID: uid, Controller: &isController}}
+	}
+	replicaSet := func(name string, uid types.UID, owner string, ownerUID types.UID) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Namespace: "default", UID: uid, OwnerReferences: controller("Deployment", owner, ownerUID)}}
+	}
+	pod := func(name string, phase corev1.PodPhase, labels map[string]string, owner string, ownerUID types.UID) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels, OwnerReferences: controller("ReplicaSet", owner, ownerUID)},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "sidecar"}, {Name: "nginx"}}},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+	}
+	web := map[string]string{"app": "web", "track": "stable"}
+	simpleClient := testclient.NewSimpleClientset(app,
+		replicaSet("app-rs", "app-rs-uid", "app", "app-uid"),
+		replicaSet("canary-rs", "canary-rs-uid", "canary", "canary-uid"),
+		pod("web-1", corev1.PodRunning, web, "app-rs", "app-rs-uid"),
+		pod("web-2", corev1.PodRunning, web, "app-rs", "app-rs-uid"),
+		pod("web-3", corev1.PodPending, web, "app-rs", "app-rs-uid"),
+		// The canary deployment's pods share the labels, but aren't the deployment's
+		pod("canary-1", corev1.PodRunning, web, "canary-rs", "canary-rs-uid"),
+		pod("other", corev1.PodRunning, map[string]string{"app": "other"}, "other-rs", "other-rs-uid"))
+	watcher := Init(simpleClient, Options{})
+	watcher.configmapStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	watcher.secretStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	var signaled []string
+	failing := map[string]bool{"web-2": true}
+	watcher.exec = func(pod types.NamespacedName, container string, command []string) error {
+		if failing[pod.Name] {
+			return errors.New("unable to upgrade connection")
+		}
+		assert.Equal(t, "nginx", container)
+		assert.Equal(t, []string{"kill", "-s", "HUP", "1"}, command)
+		signaled = append(signaled, pod.Name)
+		return nil
+	}
+	key := workload{kind: deploymentKind, name: splitNamespacedName("default/app")}
+	watcher.syncWorkload(deploymentKind, app)
+	watcher.watchedLock.Lock()
+	watcher.RestartAll(configmapKind, splitNamespacedName("default/config"), nil)
+	hash := watcher.configHash(key)
+	watcher.watchedLock.Unlock()
+
+	// Only the running pods the deployment controls are signaled, and a failure on one of them fails the restart
+	assert.NotNil(t, watcher.restart(key))
+	assert.Equal(t, []string{"web-1"}, signaled)
+
+	// Once it's retried, the pods signaled already aren't signaled again
+	failing["web-2"] = false
+	assert.Nil(t, watcher.restart(key))
+	assert.Equal(t, []string{"web-1", "web-2"}, signaled)
+	for _, name := range []string{"web-1", "web-2"} {
+		signaledPod, err := simpleClient.CoreV1().Pods("default").Get(name, metav1.GetOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, hash, signaledPod.Annotations[hashAnnotation])
+	}
+
+	// The deployment's pod template isn't changed
+	deployment, err := simpleClient.AppsV1().Deployments("default").Get("app", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, deployment.Spec.Template.Annotations[hashAnnotation])
+
+	// Without a selector the pods aren't signaled, nor without a REST config
+	assert.NotNil(t, watcher.signalPods(key, &reloadSignal{name: "HUP"}, &metav1.LabelSelector{}, "app-uid", "other"))
+	watcher.exec = nil
+	assert.NotNil(t, watcher.signalPods(key, &reloadSignal{name: "HUP"}, app.Spec.Selector, "app-uid", "other"))
+	assert.Equal(t, []string{"web-1", "web-2"}, signaled)
+}
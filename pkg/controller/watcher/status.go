@@ -0,0 +1,253 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+// statusAnnotation is written on the watched workloads, holding their workloadStatus as JSON.
+const statusAnnotation string = "watcher.ibm.com/status"
+
+// workloadStatus is what the watcher reports in a workload's status annotation.
+type workloadStatus struct {
+	State v1alpha1.WatchState `json:"state"`
+	// Message names the configmaps and secrets that weren't found, or the namespace that isn't allowed
+	Message string `json:"message,omitempty"`
+	// ConfigHash is the hash of the configmaps and secrets the workload watches, as last observed
+	ConfigHash string `json:"configHash,omitempty"`
+	// LastRestart is when the watcher last restarted the workload
+	LastRestart *metav1.Time `json:"lastRestart,omitempty"`
+}
+
+// statusUpdate is a status to write on a workload, or nil status to remove the status annotation.
+type statusUpdate struct {
+	key    workload
+	status *workloadStatus
+}
+
+// parseStatus returns the status in the workload's status annotation, or nil if there's none or it can't be parsed.
+func parseStatus(annotations map[string]string) *workloadStatus {
+	value, ok := annotations[statusAnnotation]
+	if !ok {
+		return nil
+	}
+	status := &workloadStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		klog.V(2).Infof("Overwriting the %s annotation %q that can't be parsed: %s", statusAnnotation, value, err.Error())
+		return nil
+	}
+	return status
+}
+
+// statusValue returns the status as written in the status annotation.
+func statusValue(status *workloadStatus) string {
+	if status == nil {
+		return ""
+	}
+	value, err := json.Marshal(status)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
+
+// observeStatus remembers the status annotation on a workload, and when it was last restarted unless a later restart
+// is already known, and returns the status. It's called with watchedLock held.
+func (w *WatcherController) observeStatus(key workload, annotations map[string]string) *workloadStatus {
+	status := parseStatus(annotations)
+	if status == nil {
+		return nil
+	}
+	if _, ok := w.statuses[key]; !ok {
+		w.statuses[key] = status
+	}
+	if status.LastRestart != nil {
+		if restarted, ok := w.restarts[key]; !ok || restarted.Before(status.LastRestart) {
+			w.restarts[key] = *status.LastRestart
+		}
+	}
+	return status
+}
+
+// missingReferences returns the configmaps and secrets referenced that aren't in the informer caches. It's called
+// with watchedLock held.
+func (w *WatcherController) missingReferences(refs *references) []string {
+	var missing []string
+	for _, name := range refs.configmaps {
+		if _, ok := lookup(w.configmapStores, name); !ok {
+			missing = append(missing, configmapKind+" "+name.String())
+		}
+	}
+	for _, name := range refs.secrets {
+		if _, ok := lookup(w.secretStores, name); !ok {
+			missing = append(missing, secretKind+" "+name.String())
+		}
+	}
+	return missing
+}
+
+// desiredStatus returns the status of a watched workload: whether every configmap and secret it references was
+// found, the hash of them, and when it was last restarted. It's called with watchedLock held.
+func (w *WatcherController) desiredStatus(key workload) *workloadStatus {
+	status := &workloadStatus{State: v1alpha1.WatchingState, ConfigHash: w.configHash(key)}
+	if restarted, ok := w.restarts[key]; ok {
+		status.LastRestart = &restarted
+	}
+	if missing := w.missingReferences(w.watchedWorkloads[key]); len(missing) > 0 {
+		status.State = v1alpha1.ConfigMapNotFoundState
+		status.Message = "Unable to find " + strings.Join(missing, ", ")
+	}
+	return status
+}
+
+// refreshStatus returns the update to the workload's status, if it differs from the current one. Workloads that
+// aren't watched anymore have their status removed, if they have one. Watched workloads aren't reported on until the
+// informers have synced, so configmaps and secrets missing from the caches aren't reported as not found. It's called
+// with watchedLock held.
+func (w *WatcherController) refreshStatus(key workload, current *workloadStatus) (statusUpdate, bool) {
+	if _, ok := w.watchedWorkloads[key]; !ok {
+		_, known := w.statuses[key]
+		delete(w.statuses, key)
+		delete(w.restarts, key)
+		return statusUpdate{key: key}, known || current != nil
+	}
+	if !w.reporting {
+		return statusUpdate{}, false
+	}
+	desired := w.desiredStatus(key)
+	w.statuses[key] = desired
+	if current != nil && statusValue(current) == statusValue(desired) {
+		return statusUpdate{}, false
+	}
+	return statusUpdate{key: key, status: desired}, true
+}
+
+// startReporting reports the status of every watched workload, once the informers have synced.
+func (w *WatcherController) startReporting() {
+	var updates []statusUpdate
+	w.watchedLock.Lock()
+	w.reporting = true
+	for key := range w.watchedWorkloads {
+		if update, ok := w.refreshStatus(key, w.statuses[key]); ok {
+			updates = append(updates, update)
+		}
+	}
+	w.watchedLock.Unlock()
+	w.writeStatuses(updates)
+}
+
+// stopReporting stops the status reports once Run's event handlers have returned, until it's started again.
+func (w *WatcherController) stopReporting() {
+	w.watchedLock.Lock()
+	defer w.watchedLock.Unlock()
+	w.reporting = false
+}
+
+// reportRestart reports the status of a workload that was restarted, or that would have been in dry run.
+func (w *WatcherController) reportRestart(key workload, restarted bool) {
+	w.watchedLock.Lock()
+	if _, ok := w.watchedWorkloads[key]; ok && restarted {
+		w.restarts[key] = metav1.Now().Rfc3339Copy()
+	}
+	update, ok := w.refreshStatus(key, w.statuses[key])
+	w.watchedLock.Unlock()
+	if ok {
+		w.writeStatus(update)
+	}
+}
+
+// reportWatching reports the status of the workloads watching a configmap or secret that was created or deleted.
+func (w *WatcherController) reportWatching(resourceKind string, resource types.NamespacedName) {
+	var updates []statusUpdate
+	w.watchedLock.Lock()
+	watched := w.watchedConfigmaps
+	if resourceKind == secretKind {
+		watched = w.watchedSecrets
+	}
+	if mapper, ok := watched[resource]; ok {
+		for _, key := range mapper.workloads(nil) {
+			if update, ok := w.refreshStatus(key, w.statuses[key]); ok {
+				updates = append(updates, update)
+			}
+		}
+	}
+	w.watchedLock.Unlock()
+	w.writeStatuses(updates)
+}
+
+// reportNamespaceNotAllowed reports that a workload opting in from a namespace that isn't allowed isn't watched.
+// Workloads another watcher, allowed in their namespace, reports the status of are left alone.
+func (w *WatcherController) reportNamespaceNotAllowed(key workload, annotations map[string]string) {
+	current := parseStatus(annotations)
+	if current != nil && current.State != v1alpha1.NamespaceNotAllowedState {
+		return
+	}
+	desired := &workloadStatus{
+		State:   v1alpha1.NamespaceNotAllowedState,
+		Message: fmt.Sprintf("Namespace %s isn't allowed", key.name.Namespace),
+	}
+	if statusValue(current) != statusValue(desired) {
+		w.writeStatus(statusUpdate{key: key, status: desired})
+	}
+}
+
+// writeStatuses writes the status updates. It's called without watchedLock held, since it calls the API server.
+func (w *WatcherController) writeStatuses(updates []statusUpdate) {
+	for _, update := range updates {
+		w.writeStatus(update)
+	}
+}
+
+// writeStatus patches the status annotation on the workload, removing it for a nil status. Only the workload's
+// metadata is patched, so its pods aren't rolled. Failures are logged, the status is written again on the next
+// change. It's called without watchedLock held, since it calls the API server.
+func (w *WatcherController) writeStatus(update statusUpdate) {
+	var value interface{}
+	if update.status != nil {
+		value = statusValue(update.status)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{statusAnnotation: value},
+		},
+	})
+	if err != nil {
+		klog.Errorf("Unable to marshal the status of %s %s: %s", update.key.kind, update.key.name.String(), err.Error())
+		return
+	}
+	klog.V(3).Infof("Writing the status of %s %s: %v", update.key.kind, update.key.name.String(), value)
+	name := update.key.name
+	if kind, ok := w.dynamicKind(update.key.kind); ok {
+		_, err = w.dynamicClient.Resource(kind.Resource).Namespace(name.Namespace).Patch(name.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		switch update.key.kind {
+		case deploymentKind:
+			_, err = w.client.AppsV1().Deployments(name.Namespace).Patch(name.Name, types.MergePatchType, patch)
+		case daemonsetKind:
+			_, err = w.client.AppsV1().DaemonSets(name.Namespace).Patch(name.Name, types.MergePatchType, patch)
+		case statefulsetKind:
+			_, err = w.client.AppsV1().StatefulSets(name.Namespace).Patch(name.Name, types.MergePatchType, patch)
+		case cronjobKind:
+			_, err = w.client.BatchV1beta1().CronJobs(name.Namespace).Patch(name.Name, types.MergePatchType, patch)
+		case jobKind:
+			_, err = w.client.BatchV1().Jobs(name.Namespace).Patch(name.Name, types.MergePatchType, patch)
+		case podKind:
+			_, err = w.client.CoreV1().Pods(name.Namespace).Patch(name.Name, types.MergePatchType, patch)
+		default:
+			err = fmt.Errorf("unknown workload kind %q", update.key.kind)
+		}
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("Unable to write the status of %s %s: %s", update.key.kind, update.key.name.String(), err.Error())
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+// deploymentStatus returns the status annotation on the deployment, nil if there's none.
+func deploymentStatus(t *testing.T, watcher *WatcherController, name string) *workloadStatus {
+	deployment, err := watcher.client.AppsV1().Deployments("default").Get(name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	if _, ok := deployment.Annotations[statusAnnotation]; !ok {
+		return nil
+	}
+	status := parseStatus(deployment.Annotations)
+	assert.NotNil(t, status)
+	return status
+}
+
+func TestWorkloadStatus(t *testing.T) {
+	app := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app",
+		Namespace:   "default",
+		Annotations: map[string]string{watcherAnnotation: "default/config"},
+	}}
+	simpleClient := testclient.NewSimpleClientset(app)
+	hashKey := []byte("key")
+	watcher := Init(simpleClient, Options{HashKey: hashKey})
+	watcher.configmapStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	watcher.secretStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	key := workload{kind: deploymentKind, name: splitNamespacedName("default/app")}
+
+	// Nothing is reported until the informers have synced
+	watcher.syncWorkload(deploymentKind, app)
+	assert.Nil(t, deploymentStatus(t, watcher, "app"))
+
+	// The configmap hasn't been created yet
+	watcher.startReporting()
+	status := deploymentStatus(t, watcher, "app")
+	assert.Equal(t, v1alpha1.ConfigMapNotFoundState, status.State)
+	assert.Equal(t, "Unable to find configmap default/config", status.Message)
+	assert.Nil(t, status.LastRestart)
+
+	// Once it is, the workload is watching it
+	config := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "default"}, Data: map[string]string{"a": "1"}}
+	assert.Nil(t, watcher.configmapStores[""].Add(config))
+	watcher.configmapHandler().OnAdd(config)
+	status = deploymentStatus(t, watcher, "app")
+	assert.Equal(t, v1alpha1.WatchingState, status.State)
+	assert.Empty(t, status.Message)
+	assert.Equal(t, watcher.configHash(key), status.ConfigHash)
+
+	// The last restart is recorded
+	watcher.reportRestart(key, true)
+	status = deploymentStatus(t, watcher, "app")
+	assert.NotNil(t, status.LastRestart)
+
+	// Syncing the workload with the status it already has doesn't write it again, even for a restarted watcher
+	synced, err := simpleClient.AppsV1().Deployments("default").Get("app", metav1.GetOptions{})
+	assert.Nil(t, err)
+	restarted := Init(simpleClient, Options{HashKey: hashKey})
+	restarted.configmapStores[""] = watcher.configmapStores[""]
+	restarted.secretStores[""] = watcher.secretStores[""]
+	restarted.syncWorkload(deploymentKind, synced)
+	simpleClient.ClearActions()
+	restarted.startReporting()
+	restarted.syncWorkload(deploymentKind, synced)
+	assert.Empty(t, simpleClient.Actions())
+	assert.Equal(t, status.LastRestart.Time, restarted.restarts[key].Time)
+
+	// A workload that isn't watching anything anymore has its status removed
+	delete(synced.Annotations, watcherAnnotation)
+	restarted.syncWorkload(deploymentKind, synced)
+	assert.Nil(t, deploymentStatus(t, watcher, "app"))
+	assert.Empty(t, restarted.statuses)
+	assert.Empty(t, restarted.restarts)
+}
+
+func TestNamespaceNotAllowedStatus(t *testing.T) {
+	other := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+		Name:        "other",
+		Namespace:   "default",
+		Annotations: map[string]string{watcherAnnotation: "default/config"},
+	}}
+	watched := other.DeepCopy()
+	watched.Name = "watched"
+	watched.Annotations[statusAnnotation] = `{"state":"Watching"}`
+	watcher := Init(testclient.NewSimpleClientset(other, watched), Options{RestrictNamespaces: true, AllowedNamespaces: map[string]struct{}{"allowed": {}}})
+
+	watcher.syncWorkload(deploymentKind, other)
+	status := deploymentStatus(t, watcher, "other")
+	assert.Equal(t, v1alpha1.NamespaceNotAllowedState, status.State)
+	assert.Equal(t, "Namespace default isn't allowed", status.Message)
+	assert.Empty(t, watcher.watchedWorkloads)
+
+	// The status another watcher reports is left alone
+	watcher.syncWorkload(deploymentKind, watched)
+	assert.Equal(t, v1alpha1.WatchingState, deploymentStatus(t, watcher, "watched").State)
+}
@@ -3,10 +3,24 @@
 package watcher
 
 import (
+	"bytes"
+	"fmt"
+	"sort"
 	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
 )
 
 // splitNamespacedName turns the string form of a namespaced name
@@ -19,70 +33,385 @@ func splitNamespacedName(nameStr string) types.NamespacedName {
 	return types.NamespacedName{Namespace: nameStr[:splitPoint], Name: nameStr[splitPoint+1:]}
 }
 
+// splitNamespacedNames parses an annotation value naming one or more resources, either as a comma-separated
+// list or as a YAML list of <namespace>/<name> entries. It returns every valid name, without duplicates, and an
+// error for each entry that could not be parsed.
+func splitNamespacedNames(value string) ([]types.NamespacedName, []error) {
+	var entries []string
+	if trimmed := strings.TrimSpace(value); strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "-") {
+		if err := yaml.Unmarshal([]byte(trimmed), &entries); err != nil {
+			return nil, []error{fmt.Errorf("unable to parse %q as a YAML list: %s", value, err.Error())}
+		}
+	} else {
+		entries = strings.Split(trimmed, ",")
+	}
+
+	var names []types.NamespacedName
+	var errs []error
+	seen := make(map[types.NamespacedName]struct{})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name := splitNamespacedName(entry)
+		if name.Namespace == "" || len(validation.IsDNS1123Label(name.Namespace)) > 0 || len(validation.IsDNS1123Subdomain(name.Name)) > 0 {
+			errs = append(errs, fmt.Errorf("invalid entry %q, expected <namespace>/<name>", entry))
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	return names, errs
+}
+
+// configmapChanged is true if the data or binary data of the configmap, or one of the compared labels or
+// annotations, changed. Other metadata changes, such as to managed fields or the resource version, are ignored.
+func (w *WatcherController) configmapChanged(old, new *corev1.ConfigMap) bool {
+	return !equality.Semantic.DeepEqual(old.Data, new.Data) ||
+		!equality.Semantic.DeepEqual(old.BinaryData, new.BinaryData) ||
+		w.comparedMetadataChanged(&old.ObjectMeta, &new.ObjectMeta)
+}
+
+// secretChanged is true if the data of the secret, or one of the compared labels or annotations, changed.
+func (w *WatcherController) secretChanged(old, new *corev1.Secret) bool {
+	return !equality.Semantic.DeepEqual(old.Data, new.Data) ||
+		w.comparedMetadataChanged(&old.ObjectMeta, &new.ObjectMeta)
+}
+
+// changedConfigmapKeys returns the keys of the data and binary data that were added, removed, or changed.
+func changedConfigmapKeys(old, new *corev1.ConfigMap) map[string]struct{} {
+	changed := make(map[string]struct{})
+	for key, value := range old.Data {
+		if newValue, ok := new.Data[key]; !ok || newValue != value {
+			changed[key] = struct{}{}
+		}
+	}
+	for key := range new.Data {
+		if _, ok := old.Data[key]; !ok {
+			changed[key] = struct{}{}
+		}
+	}
+	for key, value := range old.BinaryData {
+		if newValue, ok := new.BinaryData[key]; !ok || !bytes.Equal(newValue, value) {
+			changed[key] = struct{}{}
+		}
+	}
+	for key := range new.BinaryData {
+		if _, ok := old.BinaryData[key]; !ok {
+			changed[key] = struct{}{}
+		}
+	}
+	return changed
+}
+
+// changedSecretKeys returns the keys of the data that were added, removed, or changed.
+func changedSecretKeys(old, new *corev1.Secret) map[string]struct{} {
+	changed := make(map[string]struct{})
+	for key, value := range old.Data {
+		if newValue, ok := new.Data[key]; !ok || !bytes.Equal(newValue, value) {
+			changed[key] = struct{}{}
+		}
+	}
+	for key := range new.Data {
+		if _, ok := old.Data[key]; !ok {
+			changed[key] = struct{}{}
+		}
+	}
+	return changed
+}
+
+// parseKeys parses the comma-separated keys in the given annotation of a workload into a key filter, logging each
+// key that isn't a valid configmap or secret key. A missing or empty annotation subscribes to every key.
+func parseKeys(kind string, workloadName types.NamespacedName, annotation string, annotations map[string]string) keyFilter {
+	value, ok := annotations[annotation]
+	if !ok {
+		return nil
+	}
+	var keys keyFilter
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			klog.Errorf("Invalid key %q in the %s annotation on %s %s: %s", key, annotation, kind, workloadName, strings.Join(errs, ", "))
+			continue
+		}
+		if keys == nil {
+			keys = make(keyFilter)
+		}
+		keys[key] = struct{}{}
+	}
+	return keys
+}
+
+// comparedMetadataChanged is true if any of the labels or annotations configured for comparison was added, removed,
+// or changed its value.
+func (w *WatcherController) comparedMetadataChanged(old, new *metav1.ObjectMeta) bool {
+	for _, key := range w.comparedLabels {
+		oldValue, oldOk := old.Labels[key]
+		newValue, newOk := new.Labels[key]
+		if oldOk != newOk || oldValue != newValue {
+			return true
+		}
+	}
+	for _, key := range w.comparedAnnotations {
+		oldValue, oldOk := old.Annotations[key]
+		newValue, newOk := new.Annotations[key]
+		if oldOk != newOk || oldValue != newValue {
+			return true
+		}
+	}
+	return false
+}
+
 // print is for debugging purposes, it prints out the current list of configmaps being watched
-// as well as the deployments, daemonsets, and statefulsets that specify them.
+// as well as the workloads that specify them.
 func print(watchedConfigmaps map[types.NamespacedName]*ConfigMapper) {
 	if klog.V(5) {
 		klog.Infof("Watched configmaps: %v", watchedConfigmaps)
 		for name, mapper := range watchedConfigmaps {
-			klog.Infof("configmap %s count: %d", name.String(), mapper.Mark)
+			klog.Infof("configmap %s", name.String())
 			klog.Info("Deployments: ")
-			for dName, deployment := range mapper.Deployments {
-				klog.Infof("[%s] count: %d", dName, deployment)
+			for dName, keys := range mapper.Deployments {
+				klog.Infof("[%s] keys: %v", dName, keys)
 			}
 			klog.Info("Daemonsets: ")
-			for dName, daemonset := range mapper.Daemonsets {
-				klog.Infof("[%s] count: %d", dName, daemonset)
+			for dName, keys := range mapper.Daemonsets {
+				klog.Infof("[%s] keys: %v", dName, keys)
 			}
 			klog.Info("Statefulsets: ")
-			for sName, statefulset := range mapper.Statefulsets {
-				klog.Infof("[%s] count: %d", sName, statefulset)
+			for sName, keys := range mapper.Statefulsets {
+				klog.Infof("[%s] keys: %v", sName, keys)
+			}
+			klog.Info("Cronjobs: ")
+			for cName, keys := range mapper.Cronjobs {
+				klog.Infof("[%s] keys: %v", cName, keys)
+			}
+			klog.Info("Jobs: ")
+			for jName, keys := range mapper.Jobs {
+				klog.Infof("[%s] keys: %v", jName, keys)
+			}
+			klog.Info("Pods: ")
+			for pName, keys := range mapper.Pods {
+				klog.Infof("[%s] keys: %v", pName, keys)
+			}
+			for kind, workloads := range mapper.Custom {
+				klog.Infof("%s: ", kind)
+				for wName, keys := range workloads {
+					klog.Infof("[%s] keys: %v", wName, keys)
+				}
 			}
 		}
 	}
 }
 
-// RemoveStale is a garbage collector, it'll loop through all configmaps being watched and remove the ones that don't have
-// the same value for their Mark as the counter passed in. Same for deployments/daemonsets/statefulsets.
-func removeStale(count uint, watchedConfigmaps map[types.NamespacedName]*ConfigMapper) {
-	// Loop through the config maps
-	for name, mapper := range watchedConfigmaps {
-		if mapper.Mark != count { // Hasn't been updated - delete it
-			klog.V(2).Infof("Removing configmap %s since its count is %d but the current stored counter is %d", name, mapper.Mark, count)
-			if _, ok := watchedConfigmaps[name]; ok {
-				delete(watchedConfigmaps, name)
-				close(*mapper.stopCh)
+// removeUnwatched is a garbage collector, it'll remove the named configmaps that no workload watches anymore from the
+// watched list. It returns the number removed.
+func removeUnwatched(names []types.NamespacedName, watchedConfigmaps map[types.NamespacedName]*ConfigMapper) int {
+	removed := 0
+	for _, name := range names {
+		mapper, ok := watchedConfigmaps[name]
+		if !ok || !mapper.empty() {
+			continue
+		}
+		klog.V(2).Infof("Removing %s since nothing watches it anymore", name)
+		delete(watchedConfigmaps, name)
+		removed++
+	}
+	klog.V(5).Info("Finished removing unwatched resources")
+	return removed
+}
+
+// mergeReferences combines the references every source has for a workload. The workload subscribes to the union of
+// the keys the sources subscribe to, or every key if one of them does, and is in dry run, debounced, or reloaded with
+// a signal, if one of them has it so. Nil is returned if there are no sources.
+func mergeReferences(sources map[string]*references) *references {
+	if len(sources) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	if len(names) == 1 {
+		return sources[names[0]]
+	}
+	sort.Strings(names)
+
+	merged := &references{}
+	var configmapFilters, secretFilters []keyFilter
+	for _, name := range names {
+		refs := sources[name]
+		if merged.uid == "" {
+			merged.uid = refs.uid
+		}
+		merged.configmaps = appendNames(merged.configmaps, refs.configmaps)
+		if len(refs.configmaps) > 0 {
+			configmapFilters = append(configmapFilters, refs.configmapKeys)
+		}
+		merged.secrets = appendNames(merged.secrets, refs.secrets)
+		if len(refs.secrets) > 0 {
+			secretFilters = append(secretFilters, refs.secretKeys)
+		}
+		merged.dryRun = merged.dryRun || refs.dryRun
+		if merged.signal == nil {
+			merged.signal = refs.signal
+		}
+		if merged.podSelector == nil {
+			merged.podSelector = refs.podSelector
+		}
+		if refs.debounce != nil && (merged.debounce == nil || *refs.debounce > *merged.debounce) {
+			merged.debounce = refs.debounce
+		}
+	}
+	merged.configmapKeys = unionKeys(configmapFilters)
+	merged.secretKeys = unionKeys(secretFilters)
+	return merged
+}
+
+// appendNames appends the names that aren't in the list yet.
+func appendNames(list []types.NamespacedName, names []types.NamespacedName) []types.NamespacedName {
+	for _, name := range names {
+		found := false
+		for _, existing := range list {
+			if existing == name {
+				found = true
+				break
 			}
-		} else { // Loop through all of its associated objects
-			// Deployments
-			for deploymentName, deploymentCount := range watchedConfigmaps[name].Deployments {
-				if deploymentCount != count { // Hasn't been found recently - remove it
-					klog.V(2).Infof("Removing deployment %s since its count is %d but the current stored counter is %d", deploymentName, deploymentCount, count)
-					if _, ok := watchedConfigmaps[name].Deployments[deploymentName]; ok {
-						delete(watchedConfigmaps[name].Deployments, deploymentName)
-					}
+		}
+		if !found {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// unionKeys returns the keys any of the filters subscribes to, or nil if one of them subscribes to every key.
+func unionKeys(filters []keyFilter) keyFilter {
+	union := keyFilter{}
+	for _, filter := range filters {
+		if filter == nil {
+			return nil
+		}
+		for key := range filter {
+			union[key] = struct{}{}
+		}
+	}
+	return union
+}
+
+// podTemplate returns the pod template of a deployment, daemonset, statefulset, or job, the pod template in a
+// cronjob's job template, or a pod's own metadata and spec.
+func podTemplate(obj interface{}) (*corev1.PodTemplateSpec, bool) {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		return &workload.Spec.Template, true
+	case *appsv1.DaemonSet:
+		return &workload.Spec.Template, true
+	case *appsv1.StatefulSet:
+		return &workload.Spec.Template, true
+	case *batchv1beta1.CronJob:
+		return &workload.Spec.JobTemplate.Spec.Template, true
+	case *batchv1.Job:
+		return &workload.Spec.Template, true
+	case *corev1.Pod:
+		return &corev1.PodTemplateSpec{ObjectMeta: workload.ObjectMeta, Spec: workload.Spec}, true
+	}
+	return nil, false
+}
+
+// workloadSelector returns the selector the workload finds its pods by, from its spec.selector, or else the labels
+// on its pod template for workloads without one, such as cronjobs. It's nil without either.
+func workloadSelector(obj interface{}, template *corev1.PodTemplateSpec) *metav1.LabelSelector {
+	var selector *metav1.LabelSelector
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		selector = workload.Spec.Selector
+	case *appsv1.DaemonSet:
+		selector = workload.Spec.Selector
+	case *appsv1.StatefulSet:
+		selector = workload.Spec.Selector
+	case *batchv1.Job:
+		selector = workload.Spec.Selector
+	case *unstructured.Unstructured:
+		if fields, found, err := unstructured.NestedMap(workload.Object, "spec", "selector"); err == nil && found {
+			selector = &metav1.LabelSelector{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(fields, selector); err != nil {
+				klog.Errorf("Unable to read the selector of %s %s/%s: %s", workload.GetKind(), workload.GetNamespace(), workload.GetName(), err.Error())
+				selector = nil
+			}
+		}
+	}
+	if selector == nil && len(template.Labels) > 0 {
+		selector = &metav1.LabelSelector{MatchLabels: template.Labels}
+	}
+	return selector
+}
+
+// builtInControllers are the kinds of the built-in controllers whose pods are restarted through the workload that
+// owns them, by restarting it, rather than each on its own.
+var builtInControllers = map[schema.GroupKind]struct{}{
+	{Group: "apps", Kind: "ReplicaSet"}:  {},
+	{Group: "apps", Kind: "StatefulSet"}: {},
+	{Group: "apps", Kind: "DaemonSet"}:   {},
+	{Group: "batch", Kind: "Job"}:        {},
+}
+
+// builtInController returns the controller of the pod if it's one of the builtInControllers, or nil.
+func builtInController(pod metav1.Object) *metav1.OwnerReference {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return nil
+	}
+	if _, ok := builtInControllers[gv.WithKind(owner.Kind).GroupKind()]; !ok {
+		return nil
+	}
+	return owner
+}
+
+// podConfigmaps returns the configmaps in the namespace a pod spec uses, through its volumes, projected volumes, and
+// the envFrom and env of its containers and init containers, in the order they're first used.
+func podConfigmaps(namespace string, spec *corev1.PodSpec) []types.NamespacedName {
+	var names []types.NamespacedName
+	add := func(name string) {
+		if name != "" {
+			names = appendNames(names, []types.NamespacedName{{Namespace: namespace, Name: name}})
+		}
+	}
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			add(volume.ConfigMap.Name)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					add(source.ConfigMap.Name)
 				}
 			}
-			// Daemonsets
-			for daemonsetName, daemonsetCount := range watchedConfigmaps[name].Daemonsets {
-				if daemonsetCount != count { // Hasn't been found recently - remove it
-					klog.V(2).Infof("Removing daemonset %s since its count is %d but the current stored counter is %d", daemonsetName, daemonsetCount, count)
-					if _, ok := watchedConfigmaps[name].Daemonsets[daemonsetName]; ok {
-						delete(watchedConfigmaps[name].Daemonsets, daemonsetName)
-					}
+		}
+	}
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, container := range containers {
+			for _, envFrom := range container.EnvFrom {
+				if envFrom.ConfigMapRef != nil {
+					add(envFrom.ConfigMapRef.Name)
 				}
 			}
-			// Statefulsets
-			for statefulsetName, statefulsetCount := range watchedConfigmaps[name].Statefulsets {
-				if statefulsetCount != count { // Hasn't been found recently - remove it
-					klog.V(2).Infof("Removing statefulset %s since its count is %d but the current stored counter is %d", statefulsetName, statefulsetCount, count)
-					if _, ok := watchedConfigmaps[name].Statefulsets[statefulsetName]; ok {
-						delete(watchedConfigmaps[name].Statefulsets, statefulsetName)
-					}
+			for _, env := range container.Env {
+				if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil {
+					add(env.ValueFrom.ConfigMapKeyRef.Name)
 				}
 			}
 		}
 	}
-	klog.V(5).Info("Finished removing stale resources")
-	print(watchedConfigmaps)
+	return names
 }
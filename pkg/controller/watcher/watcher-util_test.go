@@ -5,9 +5,14 @@ package watcher
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	coretypes "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 func TestSplitNamespacedName(t *testing.T) {
@@ -33,33 +38,258 @@ func TestPrint(t *testing.T) {
 	nn.Namespace = "default"
 
 	var cm ConfigMapper
-	cm.stopCh = nil
-	cm.Daemonsets = make(map[types.NamespacedName]uint)
-	cm.Statefulsets = make(map[types.NamespacedName]uint)
-	cm.Deployments = make(map[types.NamespacedName]uint)
-	cm.Daemonsets[nn] = 1
-	cm.Deployments[nn] = 1
-	cm.Statefulsets[nn] = 1
+	cm.track(daemonsetKind, nn, nil)
+	cm.track(deploymentKind, nn, nil)
+	cm.track(statefulsetKind, nn, nil)
 	watchedConfigmaps[nn] = &cm
 
 	print(watchedConfigmaps)
 }
 
-func TestRemoveStale(t *testing.T) {
+func TestRemoveUnwatched(t *testing.T) {
 	var watchedConfigmaps map[types.NamespacedName]*ConfigMapper = make(map[types.NamespacedName]*ConfigMapper)
-	var nn types.NamespacedName
-	nn.Name = "test"
-	nn.Namespace = "default"
+	var watched, unwatched types.NamespacedName = splitNamespacedName("default/watched"), splitNamespacedName("default/unwatched")
 
+	watchedConfigmaps[unwatched] = &ConfigMapper{}
 	var cm ConfigMapper
-	cm.stopCh = nil
-	cm.Daemonsets = make(map[types.NamespacedName]uint)
-	cm.Statefulsets = make(map[types.NamespacedName]uint)
-	cm.Deployments = make(map[types.NamespacedName]uint)
-	cm.Daemonsets[nn] = 1
-	cm.Deployments[nn] = 1
-	cm.Statefulsets[nn] = 1
-	watchedConfigmaps[nn] = &cm
+	cm.track(deploymentKind, splitNamespacedName("default/deployment"), nil)
+	watchedConfigmaps[watched] = &cm
+
+	assert.Equal(t, 1, removeUnwatched([]types.NamespacedName{watched, unwatched}, watchedConfigmaps))
+	assert.Contains(t, watchedConfigmaps, watched)
+	assert.NotContains(t, watchedConfigmaps, unwatched)
+}
+
+func TestSplitNamespacedNames(t *testing.T) {
+	names, errs := splitNamespacedNames("default/one")
+	assert.Empty(t, errs)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "default", Name: "one"}}, names)
+
+	names, errs = splitNamespacedNames("default/one, kube-system/two,,default/one")
+	assert.Empty(t, errs)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "default", Name: "one"}, {Namespace: "kube-system", Name: "two"}}, names)
+
+	names, errs = splitNamespacedNames("- default/one\n- kube-system/two\n")
+	assert.Empty(t, errs)
+	assert.Equal(t, []types.NamespacedName{{Namespace: "default", Name: "one"}, {Namespace: "kube-system", Name: "two"}}, names)
+
+	names, errs = splitNamespacedNames("[default/one, kube-system/two]")
+	assert.Empty(t, errs)
+	assert.Len(t, names, 2)
+
+	// Every unparseable entry is reported while the valid ones are kept
+	names, errs = splitNamespacedNames("noNamespace,default/one,default/Bad_Name,/missing")
+	assert.Equal(t, []types.NamespacedName{{Namespace: "default", Name: "one"}}, names)
+	assert.Len(t, errs, 3)
+
+	names, errs = splitNamespacedNames("[default/one")
+	assert.Empty(t, names)
+	assert.Len(t, errs, 1)
+}
+
+func TestConfigmapChanged(t *testing.T) {
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	old := &coretypes.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "configmap", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string]string{"key": "value"},
+	}
+
+	// Metadata-only updates don't count as changes
+	new := old.DeepCopy()
+	new.ResourceVersion = "2"
+	new.Labels = map[string]string{"app": "test"}
+	new.Annotations = map[string]string{"note": "test"}
+	new.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl", Operation: metav1.ManagedFieldsOperationUpdate}}
+	assert.False(t, watcher.configmapChanged(old, new))
+
+	// Neither does going from no binary data to an empty map
+	new.BinaryData = map[string][]byte{}
+	assert.False(t, watcher.configmapChanged(old, new))
+
+	new = old.DeepCopy()
+	new.Data["key"] = "changed"
+	assert.True(t, watcher.configmapChanged(old, new))
+
+	new = old.DeepCopy()
+	new.BinaryData = map[string][]byte{"bin": []byte("data")}
+	assert.True(t, watcher.configmapChanged(old, new))
+
+	// Compared labels and annotations count as changes when they're added, removed, or changed
+	watcher = Init(testclient.NewSimpleClientset(), Options{ComparedLabels: []string{"app"}, ComparedAnnotations: []string{"note"}})
+	new = old.DeepCopy()
+	new.Labels = map[string]string{"app": "test"}
+	assert.True(t, watcher.configmapChanged(old, new))
+	assert.True(t, watcher.configmapChanged(new, old))
+
+	new = old.DeepCopy()
+	new.Annotations = map[string]string{"note": "test"}
+	assert.True(t, watcher.configmapChanged(old, new))
+
+	new = old.DeepCopy()
+	new.Labels = map[string]string{"other": "test"}
+	assert.False(t, watcher.configmapChanged(old, new))
+}
+
+func TestSecretChanged(t *testing.T) {
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	old := &coretypes.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string][]byte{"tls.crt": []byte("cert")},
+	}
+
+	new := old.DeepCopy()
+	new.ResourceVersion = "2"
+	new.Labels = map[string]string{"app": "test"}
+	assert.False(t, watcher.secretChanged(old, new))
+
+	new.Data["tls.crt"] = []byte("renewed")
+	assert.True(t, watcher.secretChanged(old, new))
+}
+
+func TestChangedConfigmapKeys(t *testing.T) {
+	old := &coretypes.ConfigMap{
+		Data:       map[string]string{"same": "value", "changed": "old", "removed": "value"},
+		BinaryData: map[string][]byte{"bin": []byte("old")},
+	}
+	new := &coretypes.ConfigMap{
+		Data:       map[string]string{"same": "value", "changed": "new", "added": "value"},
+		BinaryData: map[string][]byte{"bin": []byte("new")},
+	}
+	assert.Equal(t, map[string]struct{}{"changed": {}, "removed": {}, "added": {}, "bin": {}}, changedConfigmapKeys(old, new))
+	assert.Empty(t, changedConfigmapKeys(old, old.DeepCopy()))
+}
+
+func TestKeyFilterMatches(t *testing.T) {
+	var all keyFilter
+	assert.True(t, all.matches(map[string]struct{}{"app.yaml": {}}))
+	assert.True(t, all.matches(nil))
+
+	some := keyFilter{"app.yaml": {}, "logging.yaml": {}}
+	assert.True(t, some.matches(map[string]struct{}{"logging.yaml": {}, "other": {}}))
+	assert.False(t, some.matches(map[string]struct{}{"other": {}}))
+	assert.True(t, some.matches(nil))
+}
+
+func TestParseKeys(t *testing.T) {
+	nn := splitNamespacedName("default/deployment")
+	assert.Nil(t, parseKeys(deploymentKind, nn, configmapKeys, map[string]string{}))
+	assert.Nil(t, parseKeys(deploymentKind, nn, configmapKeys, map[string]string{configmapKeys: " , "}))
+	assert.Equal(t, keyFilter{"app.yaml": {}, "logging.yaml": {}},
+		parseKeys(deploymentKind, nn, configmapKeys, map[string]string{configmapKeys: "app.yaml, logging.yaml,bad key"}))
+}
+
+func TestMergeReferences(t *testing.T) {
+	assert.Nil(t, mergeReferences(nil))
+
+	one := &references{configmaps: []types.NamespacedName{splitNamespacedName("default/one")}}
+	assert.Equal(t, one, mergeReferences(map[string]*references{annotationSource: one}))
+
+	minute, second := time.Minute, time.Second
+	merged := mergeReferences(map[string]*references{
+		annotationSource: {
+			uid:           "uid",
+			configmaps:    []types.NamespacedName{splitNamespacedName("default/one"), splitNamespacedName("default/two")},
+			configmapKeys: keyFilter{"a": {}},
+			debounce:      &second,
+		},
+		"watchpolicy default/policy": {
+			configmaps:    []types.NamespacedName{splitNamespacedName("default/two")},
+			configmapKeys: keyFilter{"b": {}},
+			secrets:       []types.NamespacedName{splitNamespacedName("default/secret")},
+			dryRun:        true,
+			debounce:      &minute,
+		},
+	})
+	assert.Equal(t, types.UID("uid"), merged.uid)
+	assert.Equal(t, []types.NamespacedName{splitNamespacedName("default/one"), splitNamespacedName("default/two")}, merged.configmaps)
+	assert.Equal(t, keyFilter{"a": {}, "b": {}}, merged.configmapKeys)
+	assert.Equal(t, []types.NamespacedName{splitNamespacedName("default/secret")}, merged.secrets)
+	assert.Nil(t, merged.secretKeys)
+	assert.True(t, merged.dryRun)
+	assert.Equal(t, time.Minute, *merged.debounce)
+}
+
+func TestPodConfigmaps(t *testing.T) {
+	configmapRef := func(name string) coretypes.LocalObjectReference {
+		return coretypes.LocalObjectReference{Name: name}
+	}
+	spec := &coretypes.PodSpec{
+		Volumes: []coretypes.Volume{
+			{Name: "config", VolumeSource: coretypes.VolumeSource{ConfigMap: &coretypes.ConfigMapVolumeSource{LocalObjectReference: configmapRef("mounted")}}},
+			{Name: "projected", VolumeSource: coretypes.VolumeSource{Projected: &coretypes.ProjectedVolumeSource{Sources: []coretypes.VolumeProjection{
+				{ConfigMap: &coretypes.ConfigMapProjection{LocalObjectReference: configmapRef("projected")}},
+				{Secret: &coretypes.SecretProjection{LocalObjectReference: configmapRef("secret")}},
+			}}}},
+			{Name: "secret", VolumeSource: coretypes.VolumeSource{Secret: &coretypes.SecretVolumeSource{SecretName: "secret"}}},
+		},
+		InitContainers: []coretypes.Container{{
+			EnvFrom: []coretypes.EnvFromSource{{ConfigMapRef: &coretypes.ConfigMapEnvSource{LocalObjectReference: configmapRef("init")}}},
+		}},
+		Containers: []coretypes.Container{{
+			EnvFrom: []coretypes.EnvFromSource{
+				{ConfigMapRef: &coretypes.ConfigMapEnvSource{LocalObjectReference: configmapRef("env-from")}},
+				{SecretRef: &coretypes.SecretEnvSource{LocalObjectReference: configmapRef("secret")}},
+			},
+			Env: []coretypes.EnvVar{
+				{Name: "A", ValueFrom: &coretypes.EnvVarSource{ConfigMapKeyRef: &coretypes.ConfigMapKeySelector{LocalObjectReference: configmapRef("env"), Key: "a"}}},
+				{Name: "B", ValueFrom: &coretypes.EnvVarSource{ConfigMapKeyRef: &coretypes.ConfigMapKeySelector{LocalObjectReference: configmapRef("mounted"), Key: "b"}}},
+				{Name: "C", Value: "c"},
+			},
+		}},
+	}
+	names := []types.NamespacedName{}
+	for _, name := range []string{"mounted", "projected", "init", "env-from", "env"} {
+		names = append(names, types.NamespacedName{Namespace: "default", Name: name})
+	}
+	assert.Equal(t, names, podConfigmaps("default", spec))
+	assert.Empty(t, podConfigmaps("default", &coretypes.PodSpec{}))
+
+	// Only workloads with the auto annotation watch them, along with the ones their annotations name
+	annotated := types.NamespacedName{Namespace: "default", Name: "annotated"}
+	refs := &references{configmaps: []types.NamespacedName{annotated}}
+	discoverReferences(deploymentKind, splitNamespacedName("default/app"), map[string]string{}, spec, refs)
+	assert.Equal(t, []types.NamespacedName{annotated}, refs.configmaps)
+	discoverReferences(deploymentKind, splitNamespacedName("default/app"), map[string]string{autoAnnotation: "yes"}, spec, refs)
+	assert.Equal(t, []types.NamespacedName{annotated}, refs.configmaps)
+	discoverReferences(deploymentKind, splitNamespacedName("default/app"), map[string]string{autoAnnotation: "true", configmapKeys: "a"}, spec, refs)
+	assert.Equal(t, append([]types.NamespacedName{annotated}, names...), refs.configmaps)
+	assert.Equal(t, keyFilter{"a": {}}, refs.configmapKeys)
+}
+
+func TestBuiltInController(t *testing.T) {
+	controller := true
+	tests := []struct {
+		owner   metav1.OwnerReference
+		builtIn bool
+	}{
+		{metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app", Controller: &controller}, true},
+		{metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "app", Controller: &controller}, true},
+		{metav1.OwnerReference{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "app", Controller: &controller}, true},
+		{metav1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: "app", Controller: &controller}, true},
+		{metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app"}, false},
+		{metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "ReplicaSet", Name: "app", Controller: &controller}, false},
+		{metav1.OwnerReference{APIVersion: "argoproj.io/v1alpha1", Kind: "Rollout", Name: "app", Controller: &controller}, false},
+	}
+	for _, test := range tests {
+		pod := &coretypes.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", OwnerReferences: []metav1.OwnerReference{test.owner}}}
+		assert.Equal(t, test.builtIn, builtInController(pod) != nil, test.owner)
+	}
 
-	removeStale(0, watchedConfigmaps)
+	// A pod of a built-in workload isn't watched, even when it opts in itself
+	watcher := Init(testclient.NewSimpleClientset(), Options{})
+	watcher.configmapStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	watcher.secretStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, test := range tests[:2] {
+		pod := &coretypes.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            "app",
+			Namespace:       "default",
+			Annotations:     map[string]string{watcherAnnotation: "default/config"},
+			OwnerReferences: []metav1.OwnerReference{test.owner},
+		}}
+		watcher.syncWorkload(podKind, pod)
+	}
+	assert.Empty(t, watcher.watchedConfigmaps)
+	pod := &coretypes.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{watcherAnnotation: "default/config"}}}
+	watcher.syncWorkload(podKind, pod)
+	assert.Contains(t, watcher.watchedConfigmaps, splitNamespacedName("default/config"))
 }
@@ -9,222 +9,928 @@
 package watcher
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"reflect"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
 const (
-	watcherAnnotation string = "watcher.ibm.com/configmap-resource"
-	restartLabel      string = "watcher.ibm.com/restart-time"
-	optInLabel        string = "watcher.ibm.com/opt-in=true"
+	watcherAnnotation  string = "watcher.ibm.com/configmap-resource"
+	secretAnnotation   string = "watcher.ibm.com/secret-resource"
+	configmapKeys      string = "watcher.ibm.com/configmap-keys"
+	secretKeys         string = "watcher.ibm.com/secret-keys"
+	hashAnnotation     string = "watcher.ibm.com/config-hash"
+	dryRunAnnotation   string = "watcher.ibm.com/dry-run"
+	debounceAnnotation string = "watcher.ibm.com/debounce"
+	autoAnnotation     string = "watcher.ibm.com/auto"
+	strategyAnnotation string = "watcher.ibm.com/strategy"
+	signalAnnotation   string = "watcher.ibm.com/signal"
+	signalContainer    string = "watcher.ibm.com/signal-container"
+	optInLabel         string = "watcher.ibm.com/opt-in=true"
 )
 
-var watchedConfigmaps map[types.NamespacedName]*ConfigMapper = make(map[types.NamespacedName]*ConfigMapper)
-var listOptions metav1.ListOptions = metav1.ListOptions{LabelSelector: optInLabel}
-var allowedNamespaces map[string]struct{}
-var storedCounter uint = 0
-var clean uint = 0
-var restrictNamespaces bool
+// ignoredSecretTypes selects the secrets the secret informers cache, leaving out the service account tokens and Helm
+// release secrets that are in every namespace and that workloads don't watch, so their data isn't held in memory.
+const ignoredSecretTypes string = "type!=kubernetes.io/service-account-token,type!=helm.sh/release.v1"
 
+// defaultShutdownGracePeriod is how long Run waits for the queued restarts when Options doesn't set it.
+const defaultShutdownGracePeriod time.Duration = 30 * time.Second
+
+const (
+	configmapKind   string = "configmap"
+	secretKind      string = "secret"
+	deploymentKind  string = "deployment"
+	daemonsetKind   string = "daemonset"
+	statefulsetKind string = "statefulset"
+	cronjobKind     string = "cronjob"
+	jobKind         string = "job"
+	podKind         string = "pod"
+)
+
+// ConfigMapper holds the deployments, daemonsets, statefulsets, cronjobs, jobs, pods, and workloads of the
+// configured workload kinds watching a single configmap or secret, along with the keys each of them subscribes to.
 type ConfigMapper struct {
-	stopCh       *chan struct{}
-	Deployments  map[types.NamespacedName]uint
-	Daemonsets   map[types.NamespacedName]uint
-	Statefulsets map[types.NamespacedName]uint
-	Mark         uint
+	Deployments  map[types.NamespacedName]keyFilter
+	Daemonsets   map[types.NamespacedName]keyFilter
+	Statefulsets map[types.NamespacedName]keyFilter
+	Cronjobs     map[types.NamespacedName]keyFilter
+	Jobs         map[types.NamespacedName]keyFilter
+	Pods         map[types.NamespacedName]keyFilter
+	// Custom holds the workloads of the configured workload kinds, keyed by the kind's name
+	Custom map[string]map[types.NamespacedName]keyFilter
+}
+
+// keyFilter holds the keys of a configmap or secret a workload subscribes to. A nil filter subscribes to every key.
+type keyFilter map[string]struct{}
+
+// matches is true if the filter subscribes to any of the changed keys. Nil changed keys, meaning the whole
+// configmap or secret changed, match every filter.
+func (f keyFilter) matches(changed map[string]struct{}) bool {
+	if f == nil || changed == nil {
+		return true
+	}
+	for key := range changed {
+		if _, ok := f[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// track records the workload of the given kind and the keys it subscribes to.
+func (c *ConfigMapper) track(kind string, workload types.NamespacedName, keys keyFilter) {
+	switch kind {
+	case deploymentKind:
+		if c.Deployments == nil {
+			c.Deployments = make(map[types.NamespacedName]keyFilter)
+		}
+		c.Deployments[workload] = keys
+	case daemonsetKind:
+		if c.Daemonsets == nil {
+			c.Daemonsets = make(map[types.NamespacedName]keyFilter)
+		}
+		c.Daemonsets[workload] = keys
+	case statefulsetKind:
+		if c.Statefulsets == nil {
+			c.Statefulsets = make(map[types.NamespacedName]keyFilter)
+		}
+		c.Statefulsets[workload] = keys
+	case cronjobKind:
+		if c.Cronjobs == nil {
+			c.Cronjobs = make(map[types.NamespacedName]keyFilter)
+		}
+		c.Cronjobs[workload] = keys
+	case jobKind:
+		if c.Jobs == nil {
+			c.Jobs = make(map[types.NamespacedName]keyFilter)
+		}
+		c.Jobs[workload] = keys
+	case podKind:
+		if c.Pods == nil {
+			c.Pods = make(map[types.NamespacedName]keyFilter)
+		}
+		c.Pods[workload] = keys
+	default:
+		if c.Custom == nil {
+			c.Custom = make(map[string]map[types.NamespacedName]keyFilter)
+		}
+		if c.Custom[kind] == nil {
+			c.Custom[kind] = make(map[types.NamespacedName]keyFilter)
+		}
+		c.Custom[kind][workload] = keys
+	}
+}
+
+// untrack removes the workload of the given kind.
+func (c *ConfigMapper) untrack(kind string, workload types.NamespacedName) {
+	switch kind {
+	case deploymentKind:
+		delete(c.Deployments, workload)
+	case daemonsetKind:
+		delete(c.Daemonsets, workload)
+	case statefulsetKind:
+		delete(c.Statefulsets, workload)
+	case cronjobKind:
+		delete(c.Cronjobs, workload)
+	case jobKind:
+		delete(c.Jobs, workload)
+	case podKind:
+		delete(c.Pods, workload)
+	default:
+		delete(c.Custom[kind], workload)
+		if len(c.Custom[kind]) == 0 {
+			delete(c.Custom, kind)
+		}
+	}
+}
+
+// empty is true once no workload watches the configmap or secret anymore.
+func (c *ConfigMapper) empty() bool {
+	return len(c.Deployments) == 0 && len(c.Daemonsets) == 0 && len(c.Statefulsets) == 0 && len(c.Cronjobs) == 0 &&
+		len(c.Jobs) == 0 && len(c.Pods) == 0 && len(c.Custom) == 0
+}
+
+// workloads returns the workloads subscribing to any of the changed keys.
+func (c *ConfigMapper) workloads(changed map[string]struct{}) []workload {
+	var matched []workload
+	type kindWorkloads struct {
+		name      string
+		workloads map[types.NamespacedName]keyFilter
+	}
+	kinds := []kindWorkloads{
+		{deploymentKind, c.Deployments},
+		{daemonsetKind, c.Daemonsets},
+		{statefulsetKind, c.Statefulsets},
+		{cronjobKind, c.Cronjobs},
+		{jobKind, c.Jobs},
+		{podKind, c.Pods},
+	}
+	for name, workloads := range c.Custom {
+		kinds = append(kinds, kindWorkloads{name, workloads})
+	}
+	for _, kind := range kinds {
+		for name, keys := range kind.workloads {
+			if !keys.matches(changed) {
+				klog.V(3).Infof("Skipping %s %s since none of the keys it subscribes to changed", kind.name, name.String())
+				continue
+			}
+			matched = append(matched, workload{kind: kind.name, name: name})
+		}
+	}
+	return matched
+}
+
+// workload identifies an opted-in deployment, daemonset, statefulset, cronjob, job, pod, or workload of a configured
+// workload kind.
+type workload struct {
+	kind string
+	name types.NamespacedName
+}
+
+// references holds the configmaps and secrets named in a workload's annotations, and the keys of them it
+// subscribes to.
+type references struct {
+	// uid is the workload's, for the events recorded against it
+	uid           types.UID
+	configmaps    []types.NamespacedName
+	configmapKeys keyFilter
+	secrets       []types.NamespacedName
+	secretKeys    keyFilter
+	// dryRun is set by the workload's dry-run annotation
+	dryRun bool
+	// debounce is set by the workload's debounce annotation, overriding the debounce option
+	debounce *time.Duration
+	// signal is set by the workload's strategy annotation, to reload its pods with a signal rather than restart them
+	signal *reloadSignal
+	// podSelector is the workload's selector, which its pods are found by
+	podSelector *metav1.LabelSelector
 }
 
 // WatcherController used to watch the configmaps for changes
 type WatcherController struct {
-	client kubernetes.Interface
+	// failures counts the restarts that failed, it's first to keep it aligned for atomic access
+	failures uint64
+	client   kubernetes.Interface
+	// dynamicClient watches and restarts the workloads of workloadKinds, which are keyed by their names, and the
+	// cronjobs when cronjobsV1 is set, once Run finds the API server serves batch/v1 cronjobs
+	dynamicClient dynamic.Interface
+	workloadKinds map[string]WorkloadKind
+	cronjobsV1    bool
+	// hashKey keys the config hashes
+	hashKey []byte
+	// exec runs commands in the pods of the workloads reloaded with a signal, nil without a REST config
+	exec podExecutor
+	// allowedNamespaces, restrictNamespaces, comparedLabels, and comparedAnnotations are set from the Options
+	allowedNamespaces   map[string]struct{}
+	restrictNamespaces  bool
+	comparedLabels      []string
+	comparedAnnotations []string
+	// watchedLock guards the watched maps, which are written from the workload informers and read from the
+	// configmap and secret informers
+	watchedLock       sync.Mutex
+	watchedConfigmaps map[types.NamespacedName]*ConfigMapper
+	watchedSecrets    map[types.NamespacedName]*ConfigMapper
+	watchedWorkloads  map[workload]*references
+	// sources holds the references each source, the workload's annotations or a WatchPolicy, has for a workload,
+	// which watchedWorkloads holds the merge of
+	sources map[workload]map[string]*references
+	// configmapStores and secretStores hold the informer caches, keyed by the namespace each informer covers
+	configmapStores map[string]cache.Store
+	secretStores    map[string]cache.Store
+	// health is reported by Healthz and Readyz, which fail once it's been stale for unhealthyAfter
+	health         health
+	unhealthyAfter time.Duration
+	// handlers tracks the informers calling the event handlers, and the heartbeat, which Run starts. workers tracks
+	// the goroutines performing the restarts on the queue, and shutdownGracePeriod is how long Run waits for them to
+	// drain it when stopping.
+	handlers            sync.WaitGroup
+	workers             sync.WaitGroup
+	workerCount         int
+	shutdownGracePeriod time.Duration
+	// queue holds the workloads to restart, which changes holds the latest change of, guarded by watchedLock.
+	// throttle caps the restarts per minute, nil for no cap. stopping is cancelled by stop once Run's shutdown grace
+	// period runs out, which ends the restarts still waiting on the throttle.
+	queue    workqueue.RateLimitingInterface
+	changes  map[workload]*change
+	throttle *rate.Limiter
+	stopping context.Context
+	stop     context.CancelFunc
+	// dryRun only logs the restarts, for every workload
+	dryRun bool
+	// recreatePods creates the opted-in pods owned by nothing again once they're evicted
+	recreatePods bool
+	// recreateJobs deletes the opted-in jobs and creates them again
+	recreateJobs bool
+	// debounce is how long a workload's configmaps and secrets must go unchanged before it's restarted, and pending
+	// the restarts waiting on it, guarded by watchedLock
+	debounce time.Duration
+	pending  map[workload]*pendingRestart
+	// statuses holds the status last seen on or written to each watched workload, and restarts when each was last
+	// restarted, guarded by watchedLock. Statuses are only reported while reporting is set, once Run's informers
+	// have synced.
+	statuses  map[workload]*workloadStatus
+	restarts  map[workload]metav1.Time
+	reporting bool
+	// recorder records events on restarts, which broadcaster sends to the API server while Run is running
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+}
+
+// Options holds the settings for the controller
+type Options struct {
+	// AllowedNamespaces are the only namespaces workloads may opt in from when RestrictNamespaces is set
+	AllowedNamespaces  map[string]struct{}
+	RestrictNamespaces bool
+	// ComparedLabels and ComparedAnnotations are the metadata keys that, along with the data, restart the
+	// workloads watching a configmap or secret when they change
+	ComparedLabels      []string
+	ComparedAnnotations []string
+	// UnhealthyAfter is how long the event handlers may stall, or the API server be unreachable, before Healthz
+	// fails. Two minutes if unset.
+	UnhealthyAfter time.Duration
+	// ShutdownGracePeriod is how long Run waits for the queued restarts to finish once it's stopped. Thirty
+	// seconds if unset.
+	ShutdownGracePeriod time.Duration
+	// Workers is how many restarts are performed at once. Two if unset.
+	Workers int
+	// RestartsPerMinute caps the restarts performed across every workload, so a change to a widely shared configmap
+	// doesn't restart them all at once. No cap if unset.
+	RestartsPerMinute int
+	// DryRun logs the restarts, and records them as events and metrics, without restarting anything
+	DryRun bool
+	// Debounce coalesces the changes made to a workload's configmaps and secrets within this period of each other
+	// into a single restart, once they've stopped. Workloads are restarted right away if unset.
+	Debounce time.Duration
+	// WorkloadKinds are the kinds of workloads, beyond deployments, daemonsets, statefulsets, cronjobs, jobs, and pods,
+	// that opt in and are restarted through DynamicClient, which is required when they're set
+	WorkloadKinds []WorkloadKind
+	DynamicClient dynamic.Interface
+	// HashKey keys the config hashes, so the data of the secrets watched can't be guessed from them. It should be the
+	// same across replicas and runs, see LoadHashKey. A random key is generated if it's unset.
+	HashKey []byte
+	// RestConfig connects to the pods/exec subresource, to send the workloads with the signal strategy their signal.
+	// Those workloads fail to restart if it's unset.
+	RestConfig *rest.Config
+	// RecreatePods evicts the opted-in pods owned by nothing and creates them again, which takes the right to create
+	// pods. Those pods fail to restart if it's unset.
+	RecreatePods bool
+	// RecreateJobs deletes the opted-in jobs that are running and creates them again, which takes the right to create
+	// and delete jobs. Those jobs fail to restart if it's unset.
+	RecreateJobs bool
 }
 
 // Init initializes the settings for the controller
-func Init(cl kubernetes.Interface, allowed map[string]struct{}, cleanFreq uint, restrict bool) *WatcherController {
+func Init(cl kubernetes.Interface, opts Options) *WatcherController {
 	klog.V(4).Info("Initializing watcher controller.")
-	allowedNamespaces = allowed
-	clean = cleanFreq
-	restrictNamespaces = restrict
-	return &WatcherController{
-		client: cl,
+	w := &WatcherController{
+		client:              cl,
+		dynamicClient:       opts.DynamicClient,
+		hashKey:             opts.HashKey,
+		workloadKinds:       make(map[string]WorkloadKind),
+		allowedNamespaces:   opts.AllowedNamespaces,
+		restrictNamespaces:  opts.RestrictNamespaces,
+		comparedLabels:      opts.ComparedLabels,
+		comparedAnnotations: opts.ComparedAnnotations,
+		watchedConfigmaps:   make(map[types.NamespacedName]*ConfigMapper),
+		watchedSecrets:      make(map[types.NamespacedName]*ConfigMapper),
+		watchedWorkloads:    make(map[workload]*references),
+		sources:             make(map[workload]map[string]*references),
+		configmapStores:     make(map[string]cache.Store),
+		secretStores:        make(map[string]cache.Store),
+		unhealthyAfter:      opts.UnhealthyAfter,
+		shutdownGracePeriod: opts.ShutdownGracePeriod,
+		workerCount:         opts.Workers,
+		queue:               newQueue(),
+		changes:             make(map[workload]*change),
+		throttle:            newThrottle(opts.RestartsPerMinute),
+		dryRun:              opts.DryRun,
+		recreatePods:        opts.RecreatePods,
+		recreateJobs:        opts.RecreateJobs,
+		debounce:            opts.Debounce,
+		pending:             make(map[workload]*pendingRestart),
+		statuses:            make(map[workload]*workloadStatus),
+		restarts:            make(map[workload]metav1.Time),
 	}
+	w.stopping, w.stop = context.WithCancel(context.Background())
+	if len(w.hashKey) == 0 {
+		key, err := newHashKey()
+		if err != nil {
+			klog.Fatalf("Unable to generate the config hash key: %s", err.Error())
+		}
+		w.hashKey = key
+	}
+	if opts.RestConfig != nil {
+		w.exec = newPodExecutor(cl, opts.RestConfig)
+	}
+	for _, kind := range opts.WorkloadKinds {
+		w.workloadKinds[kind.name()] = kind
+	}
+	w.broadcaster, w.recorder = newRecorder()
+	if w.unhealthyAfter <= 0 {
+		w.unhealthyAfter = defaultUnhealthyAfter
+	}
+	if w.shutdownGracePeriod <= 0 {
+		w.shutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	if w.workerCount <= 0 {
+		w.workerCount = defaultWorkers
+	}
+	w.health.lastContact = time.Now()
+	return w
 }
 
-// Creates the Informer for the configmap specified in order to watch it.
-func (w *WatcherController) createInformer(configmap types.NamespacedName, stopCh *chan struct{}) {
-	klog.V(5).Infof("Creating informer for %s", configmap.String())
-	informerFactory := informers.NewSharedInformerFactoryWithOptions(w.client, 0, informers.WithNamespace(configmap.Namespace),
+// Run starts the informers on the deployments, daemonsets, statefulsets, cronjobs through batch/v1 or else
+// batch/v1beta1 while either is served, jobs, pods, and workloads of the configured workload kinds that opt into this
+// watcher, and keeps the watched configmaps and secrets in step with their annotations until stopCh is closed. An
+// error is returned if the informers' caches couldn't be synced. Once stopCh is closed, Run waits up to the shutdown
+// grace period for the queued restarts to finish, along with the restarts still waiting to be debounced, and returns
+// an error if they don't, dropping those still waiting on the cap on restarts per minute. Restarts waiting to be
+// retried are dropped.
+func (w *WatcherController) Run(stopCh <-chan struct{}) error {
+	w.setRunning(true)
+	defer w.setRunning(false)
+	defer w.startRecording()()
+	defer w.queue.ShutDown()
+	w.handlers.Add(1)
+	go func() {
+		defer w.handlers.Done()
+		w.heartbeat(stopCh)
+	}()
+	// Decided before the workers, which restart the cronjobs through the version watched, start
+	w.cronjobsV1 = w.dynamicClient != nil && w.served(batchV1Cronjobs.Resource)
+	for i := 0; i < w.workerCount; i++ {
+		w.workers.Add(1)
+		go func() {
+			defer w.workers.Done()
+			w.runWorker()
+		}()
+	}
+
+	// The configmap and secret caches are synced first so the workloads' references can be checked against them
+	if err := w.startResourceInformers(stopCh); err != nil {
+		return err
+	}
+
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(w.client, 0,
 		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
-			opts.FieldSelector = fmt.Sprintf("metadata.name=%s", configmap.Name)
+			opts.LabelSelector = optInLabel
 		}))
+	deploymentInformer := informerFactory.Apps().V1().Deployments().Informer()
+	deploymentInformer.AddEventHandler(w.workloadHandler(deploymentKind))
+	daemonsetInformer := informerFactory.Apps().V1().DaemonSets().Informer()
+	daemonsetInformer.AddEventHandler(w.workloadHandler(daemonsetKind))
+	statefulsetInformer := informerFactory.Apps().V1().StatefulSets().Informer()
+	statefulsetInformer.AddEventHandler(w.workloadHandler(statefulsetKind))
+	jobInformer := informerFactory.Batch().V1().Jobs().Informer()
+	jobInformer.AddEventHandler(w.workloadHandler(jobKind))
+	podInformer := informerFactory.Core().V1().Pods().Informer()
+	podInformer.AddEventHandler(w.workloadHandler(podKind))
+	workloadInformers := []cache.SharedIndexInformer{deploymentInformer, daemonsetInformer, statefulsetInformer, jobInformer, podInformer}
+	var dynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	if w.dynamicClient != nil {
+		dynamicInformerFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(w.dynamicClient, 0, metav1.NamespaceAll,
+			func(opts *metav1.ListOptions) {
+				opts.LabelSelector = optInLabel
+			})
+	}
+	// The typed client only has batch/v1beta1 cronjobs, which aren't served from Kubernetes 1.25 on, so batch/v1
+	// cronjobs are watched through the dynamic client. An informer on a version that isn't served would never sync.
+	switch {
+	case w.cronjobsV1:
+		cronjobInformer := dynamicInformerFactory.ForResource(batchV1Cronjobs.Resource).Informer()
+		cronjobInformer.AddEventHandler(w.workloadHandler(cronjobKind))
+		workloadInformers = append(workloadInformers, cronjobInformer)
+	case w.served(batchv1beta1.SchemeGroupVersion.WithResource("cronjobs")):
+		cronjobInformer := informerFactory.Batch().V1beta1().CronJobs().Informer()
+		cronjobInformer.AddEventHandler(w.workloadHandler(cronjobKind))
+		workloadInformers = append(workloadInformers, cronjobInformer)
+	default:
+		klog.Warningf("The API server serves neither %s nor %s cronjobs, not watching cronjobs", batchV1Cronjobs.Resource.GroupVersion(), batchv1beta1.SchemeGroupVersion)
+	}
+	if len(w.workloadKinds) > 0 {
+		for name, kind := range w.workloadKinds {
+			// Like cronjobs, the informer on a resource that isn't served would never sync
+			if !w.served(kind.Resource) {
+				klog.Warningf("The API server doesn't serve %s, not watching workload kind %s", kind.Resource.String(), name)
+				continue
+			}
+			informer := dynamicInformerFactory.ForResource(kind.Resource).Informer()
+			informer.AddEventHandler(w.workloadHandler(name))
+			workloadInformers = append(workloadInformers, informer)
+		}
+	}
+
+	klog.V(2).Info("Starting workload informers")
+	if !w.startInformers(stopCh, workloadInformers...) {
+		return errors.New("unable to sync the workload informers")
+	}
+	w.setSynced()
+	klog.Info("Workload informers synced, watching for configmap and secret changes")
+	w.startReporting()
+	<-stopCh
+
+	klog.Infof("Stopping, waiting up to %s for the queued restarts to finish", w.shutdownGracePeriod)
+	stopped := make(chan struct{})
+	go func() {
+		w.handlers.Wait()
+		w.stopReporting()
+		w.flushPending()
+		w.queue.ShutDown()
+		w.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(w.shutdownGracePeriod):
+		// Ends the restarts still waiting on the cap on restarts per minute
+		w.stop()
+		return fmt.Errorf("restarts still queued after the %s shutdown grace period", w.shutdownGracePeriod)
+	}
+	klog.Info("Stopped")
+	return nil
+}
 
-	informer := informerFactory.Core().V1().ConfigMaps().Informer()
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+// startResourceInformers starts a single configmap informer and a single secret informer for the whole cluster, or
+// one of each per allowed namespace when namespaces are restricted, and waits for their caches to sync. Every
+// informer's cache is added to the stores before any is started, so the stores aren't written while the event
+// handlers read them. The secret informers leave out the ignoredSecretTypes.
+func (w *WatcherController) startResourceInformers(stopCh <-chan struct{}) error {
+	namespaces := []string{metav1.NamespaceAll}
+	if w.restrictNamespaces {
+		namespaces = namespaces[:0]
+		for namespace := range w.allowedNamespaces {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	var resourceInformers []cache.SharedIndexInformer
+	for _, namespace := range namespaces {
+		informerFactory := informers.NewSharedInformerFactoryWithOptions(w.client, 0, informers.WithNamespace(namespace))
+		configmapInformer := informerFactory.Core().V1().ConfigMaps().Informer()
+		configmapInformer.AddEventHandler(w.configmapHandler())
+		w.configmapStores[namespace] = configmapInformer.GetStore()
+		secretInformerFactory := informers.NewSharedInformerFactoryWithOptions(w.client, 0, informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.FieldSelector = ignoredSecretTypes
+			}))
+		secretInformer := secretInformerFactory.Core().V1().Secrets().Informer()
+		secretInformer.AddEventHandler(w.secretHandler())
+		w.secretStores[namespace] = secretInformer.GetStore()
+		resourceInformers = append(resourceInformers, configmapInformer, secretInformer)
+	}
+
+	klog.V(2).Infof("Starting configmap and secret informers for namespaces %q", namespaces)
+	if !w.startInformers(stopCh, resourceInformers...) {
+		return errors.New("unable to sync the configmap and secret informers")
+	}
+	return nil
+}
+
+// startInformers runs the informers until stopCh is closed and waits for their caches to sync. They're tracked as
+// handlers, so Run can wait for the event handlers they're calling to return when stopping, and counted in the
+// informers gauge while they run, which other controllers in the process share.
+func (w *WatcherController) startInformers(stopCh <-chan struct{}, informers ...cache.SharedIndexInformer) bool {
+	synced := make([]cache.InformerSynced, 0, len(informers))
+	for _, informer := range informers {
+		w.handlers.Add(1)
+		informersGauge.Inc()
+		go func(informer cache.SharedIndexInformer) {
+			defer w.handlers.Done()
+			defer informersGauge.Dec()
+			informer.Run(stopCh)
+		}(informer)
+		synced = append(synced, informer.HasSynced)
+	}
+	return cache.WaitForCacheSync(stopCh, synced...)
+}
+
+// served is true if the API server serves the resource, so an informer on it can sync. A resource that can't be
+// discovered is taken as not served.
+func (w *WatcherController) served(resource schema.GroupVersionResource) bool {
+	resources, err := w.client.Discovery().ServerResourcesForGroupVersion(resource.GroupVersion().String())
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.Errorf("Unable to discover the resources of %s: %s", resource.GroupVersion(), err.Error())
+		}
+		return false
+	}
+	for _, apiResource := range resources.APIResources {
+		if apiResource.Name == resource.Resource {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup gets a configmap or secret from the informer cache covering its namespace.
+func lookup(stores map[string]cache.Store, name types.NamespacedName) (interface{}, bool) {
+	store, ok := stores[name.Namespace]
+	if !ok {
+		if store, ok = stores[metav1.NamespaceAll]; !ok {
+			return nil, false
+		}
+	}
+	obj, exists, err := store.GetByKey(name.String())
+	if err != nil || !exists {
+		return nil, false
+	}
+	return obj, true
+}
+
+// workloadHandler keeps the watched configmaps and secrets up to date as workloads of the given kind opt in,
+// change their annotations, or go away.
+func (w *WatcherController) workloadHandler(kind string) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.syncWorkload(kind, obj)
+		},
 		UpdateFunc: func(old interface{}, new interface{}) {
-			klog.V(2).Infof("Update to configmap %s/%s occurred.", new.(*corev1.ConfigMap).ObjectMeta.Namespace, new.(*corev1.ConfigMap).ObjectMeta.Name)
-			if equal := reflect.DeepEqual(old, new); equal {
-				klog.V(2).Infof("Configmap is equal to old version.")
+			w.syncWorkload(kind, new)
+		},
+		DeleteFunc: func(obj interface{}) {
+			// Handles the tombstones left when the informer missed the delete
+			objKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				klog.Errorf("Unable to get the name of the deleted %s: %s", kind, err.Error())
+				return
+			}
+			key := workload{kind: kind, name: splitNamespacedName(objKey)}
+			klog.Infof("Found %s no longer opting in: %s", kind, key.name.String())
+			w.watchedLock.Lock()
+			w.registerSource(key, annotationSource, nil)
+			// The workload may only have stopped opting in, or still be selected by a WatchPolicy
+			update, changed := w.refreshStatus(key, w.statuses[key])
+			w.watchedLock.Unlock()
+			if changed {
+				w.writeStatus(update)
+			}
+		},
+	}
+}
+
+// syncWorkload registers an added or updated workload under the configmaps and secrets its annotations name, or its
+// pod spec uses with the auto annotation, and reports its status.
+func (w *WatcherController) syncWorkload(kind string, obj interface{}) {
+	defer prometheus.NewTimer(handlerDuration.WithLabelValues("workload")).ObserveDuration()
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		klog.Errorf("Unable to get the metadata of the %s: %s", kind, err.Error())
+		return
+	}
+	key := workload{kind: kind, name: types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()}}
+	// If we're restricting the namespaces allowed and the namespace this workload is in is not allowed, we ignore it
+	if _, ok := w.allowedNamespaces[key.name.Namespace]; w.restrictNamespaces && !ok {
+		klog.V(5).Infof("Ignoring %s %s since it's not in an allowed namespace.", kind, key.name.String())
+		w.reportNamespaceNotAllowed(key, object.GetAnnotations())
+		return
+	}
+	// The pods of a built-in workload are restarted by restarting the workload, not evicted one by one
+	if kind == podKind {
+		if owner := builtInController(object); owner != nil {
+			klog.V(2).Infof("Ignoring pod %s, which is restarted through its %s %s", key.name.String(), owner.Kind, owner.Name)
+			return
+		}
+	}
+	klog.V(2).Infof("Found %s opting in: %s", kind, key.name.String())
+	refs := w.resolveAnnotations(kind, key.name, object.GetAnnotations())
+	if template, ok := w.workloadPodTemplate(kind, obj); ok {
+		discoverReferences(kind, key.name, object.GetAnnotations(), &template.Spec, refs)
+		refs.podSelector = workloadSelector(obj, template)
+	}
+	refs.uid = object.GetUID()
+	w.watchedLock.Lock()
+	current := w.observeStatus(key, object.GetAnnotations())
+	w.registerSource(key, annotationSource, refs)
+	update, changed := w.refreshStatus(key, current)
+	w.watchedLock.Unlock()
+	if changed {
+		w.writeStatus(update)
+	}
+}
+
+// resourceHandlerKey returns the name of the configmap or secret added or deleted, handling the tombstones left
+// when the informer missed the delete.
+func resourceHandlerKey(resourceKind string, obj interface{}) (types.NamespacedName, bool) {
+	objKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("Unable to get the name of the %s: %s", resourceKind, err.Error())
+		return types.NamespacedName{}, false
+	}
+	return splitNamespacedName(objKey), true
+}
+
+// configmapHandler queues restarts of the workloads watching a configmap when its data, or one of the compared labels or
+// annotations, changes, and reports the status of the workloads watching it when it's created or deleted. Events on
+// configmaps that nothing watches are ignored.
+func (w *WatcherController) configmapHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if configmap, ok := resourceHandlerKey(configmapKind, obj); ok {
+				w.reportWatching(configmapKind, configmap)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if configmap, ok := resourceHandlerKey(configmapKind, obj); ok {
+				w.reportWatching(configmapKind, configmap)
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			defer prometheus.NewTimer(handlerDuration.WithLabelValues(configmapKind)).ObserveDuration()
+			oldConfigmap, oldOk := old.(*corev1.ConfigMap)
+			newConfigmap, newOk := new.(*corev1.ConfigMap)
+			if !oldOk || !newOk {
+				klog.Errorf("Unexpected object of type %T in the configmap informer", new)
+				return
+			}
+			configmap := types.NamespacedName{Namespace: newConfigmap.ObjectMeta.Namespace, Name: newConfigmap.ObjectMeta.Name}
+			w.watchedLock.Lock()
+			defer w.watchedLock.Unlock()
+			if _, ok := w.watchedConfigmaps[configmap]; !ok {
+				return
+			}
+			klog.V(2).Infof("Update to configmap %s occurred.", configmap.String())
+			if !w.configmapChanged(oldConfigmap, newConfigmap) {
+				klog.V(2).Infof("Configmap data is equal to old version.")
 				klog.V(4).Infof("\nold: %v \nnew: %v", old, new)
 			} else {
 				klog.Infof("Restarting all pods watching it.")
-				klog.V(2).Infof("Configmap is not equal to old version.")
+				klog.V(2).Infof("Configmap data is not equal to old version.")
 				klog.V(4).Infof("\nold: %v \nnew: %v", old, new)
-				RestartAll(w.client, configmap, watchedConfigmaps)
+				changed := changedConfigmapKeys(oldConfigmap, newConfigmap)
+				if w.comparedMetadataChanged(&oldConfigmap.ObjectMeta, &newConfigmap.ObjectMeta) {
+					changed = nil
+				}
+				w.RestartAll(configmapKind, configmap, changed)
 			}
 		},
-	})
-	klog.V(2).Infof("Starting informer for %s", configmap.String())
-	go informer.Run(*stopCh)
-}
-
-// GatherConfigMaps - periodically gathers configmaps specified by any deployment, daemonset, and/or statefulset
-// that opts into this watcher
-func (w *WatcherController) GatherConfigMaps(freq uint) {
-	storedCounter++
-	klog.V(4).Infof("Gather configmaps counter: %d", storedCounter)
-
-	// Query for deployments, daemonsets, and statefulsets that target this watcher
-	deployments, _ := w.client.AppsV1().Deployments("").List(listOptions)
-	daemonsets, _ := w.client.AppsV1().DaemonSets("").List(listOptions)
-	statefulsets, _ := w.client.AppsV1().StatefulSets("").List(listOptions)
-
-	klog.V(6).Infof("List of deployments found: %v\nList of daemonsets found: %v\nList of statefulsets found: %v", deployments, daemonsets, statefulsets)
-NEXT_DEPLOYMENT:
-	// Check for the configmap watched by each
-	for _, deployment := range deployments.Items {
-		// If we're restricting the namespaces allowed and the namespace this deployment is in is not allowed, we ignore it
-		if _, ok := allowedNamespaces[deployment.ObjectMeta.Namespace]; restrictNamespaces && !ok {
-			klog.V(5).Infof("Ignoring deployment %s/%s since it's not in an allowed namespace.", deployment.ObjectMeta.Namespace, deployment.ObjectMeta.Name)
-			continue NEXT_DEPLOYMENT
-		}
-		klog.Infof("Found deployment opting in: %s", deployment.ObjectMeta.Name)
-		if _, ok := deployment.ObjectMeta.Annotations[watcherAnnotation]; ok {
-			klog.V(5).Info("Deployment has the watcher annotation")
-			// If the deployment has the annotation, get the namespace/name of the configmap
-			configmapName := splitNamespacedName(deployment.ObjectMeta.Annotations[watcherAnnotation])
-			klog.Infof("The configmap specified by this deployment %s", configmapName.String())
-			_, err := w.client.CoreV1().ConfigMaps(configmapName.Namespace).Get(configmapName.Name, metav1.GetOptions{})
-			if err != nil {
-				klog.Errorf("ERROR: %s: unable to get configmap; invalid name/namespace for configmap [%s] or error with contacting the server", err.Error(), configmapName.String())
-				continue NEXT_DEPLOYMENT
-			}
-			if _, ok := watchedConfigmaps[configmapName]; !ok {
-				klog.V(3).Infof("Configmap doesn't exist in list yet, adding it %s and deployment %s", configmapName.String(), deployment.ObjectMeta.Name)
-				storedDeployments := make(map[types.NamespacedName]uint)
-				storedDeployments[types.NamespacedName{Name: deployment.ObjectMeta.Name, Namespace: deployment.ObjectMeta.Namespace}] = storedCounter
-				stopCh := make(chan struct{})
-				watchedConfigmaps[configmapName] = &ConfigMapper{stopCh: &stopCh, Deployments: storedDeployments, Mark: storedCounter}
-				// Create a watcher informer for it
-				w.createInformer(configmapName, &stopCh)
+	}
+}
+
+// secretHandler queues restarts of the workloads watching a secret when its data, or one of the compared labels or
+// annotations, changes, and reports the status of the workloads watching it when it's created or deleted. Events on
+// secrets that nothing watches are ignored.
+func (w *WatcherController) secretHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if secret, ok := resourceHandlerKey(secretKind, obj); ok {
+				w.reportWatching(secretKind, secret)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if secret, ok := resourceHandlerKey(secretKind, obj); ok {
+				w.reportWatching(secretKind, secret)
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			defer prometheus.NewTimer(handlerDuration.WithLabelValues(secretKind)).ObserveDuration()
+			oldSecret, oldOk := old.(*corev1.Secret)
+			newSecret, newOk := new.(*corev1.Secret)
+			if !oldOk || !newOk {
+				klog.Errorf("Unexpected object of type %T in the secret informer", new)
+				return
+			}
+			secret := types.NamespacedName{Namespace: newSecret.ObjectMeta.Namespace, Name: newSecret.ObjectMeta.Name}
+			w.watchedLock.Lock()
+			defer w.watchedLock.Unlock()
+			if _, ok := w.watchedSecrets[secret]; !ok {
+				return
+			}
+			klog.V(2).Infof("Update to secret %s occurred.", secret.String())
+			if !w.secretChanged(oldSecret, newSecret) {
+				klog.V(2).Infof("Secret data is equal to old version.")
 			} else {
-				klog.V(3).Info("Configmap already in list to watch, updating associated deployment counter.")
-				if watchedConfigmaps[configmapName].Deployments == nil {
-					storedDeployments := make(map[types.NamespacedName]uint)
-					storedDeployments[types.NamespacedName{Name: deployment.ObjectMeta.Name, Namespace: deployment.ObjectMeta.Namespace}] = storedCounter
-					watchedConfigmaps[configmapName].Deployments = storedDeployments
-				} else {
-					watchedConfigmaps[configmapName].Deployments[types.NamespacedName{Name: deployment.ObjectMeta.Name, Namespace: deployment.ObjectMeta.Namespace}] = storedCounter
+				klog.Infof("Restarting all pods watching it.")
+				klog.V(2).Infof("Secret data is not equal to old version.")
+				changed := changedSecretKeys(oldSecret, newSecret)
+				if w.comparedMetadataChanged(&oldSecret.ObjectMeta, &newSecret.ObjectMeta) {
+					changed = nil
 				}
+				w.RestartAll(secretKind, secret, changed)
 			}
-			watchedConfigmaps[configmapName].Mark = storedCounter
-		}
+		},
 	}
-NEXT_DAEMONSET:
-	// Check for the configmap watched by each
-	for _, daemonset := range daemonsets.Items {
-		// If we're restricting the namespaces allowed and the namespace this deployment is in is not allowed, we ignore it
-		if _, ok := allowedNamespaces[daemonset.ObjectMeta.Namespace]; restrictNamespaces && !ok {
-			klog.V(5).Infof("Ignoring daemonset %s/%s since it's not in an allowed namespace.", daemonset.ObjectMeta.Namespace, daemonset.ObjectMeta.Name)
-			continue NEXT_DAEMONSET
+}
+
+// resolveAnnotations parses the configmaps and secrets named in the annotations of an opted-in workload. Entries
+// that can't be parsed are logged and skipped; resources that don't exist yet are logged but still watched, so the
+// workload is picked up once they're created.
+func (w *WatcherController) resolveAnnotations(kind string, workloadName types.NamespacedName, annotations map[string]string) *references {
+	refs := &references{}
+	if value, ok := annotations[watcherAnnotation]; ok {
+		klog.V(5).Infof("%s has the configmap watcher annotation", kind)
+		configmapNames, errs := splitNamespacedNames(value)
+		for _, err := range errs {
+			klog.Errorf("Unable to parse the %s annotation on %s %s: %s", watcherAnnotation, kind, workloadName, err.Error())
 		}
-		klog.Infof("Found daemonset opting in: %s", daemonset.ObjectMeta.Name)
-		if _, ok := daemonset.ObjectMeta.Annotations[watcherAnnotation]; ok {
-			// If the daemonset has the annotation, get the namespace/name of the configmap
-			configmapName := splitNamespacedName(daemonset.ObjectMeta.Annotations[watcherAnnotation])
-			klog.Infof("The configmap specified by this daemonset %s", configmapName.String())
-			_, err := w.client.CoreV1().ConfigMaps(configmapName.Namespace).Get(configmapName.Name, metav1.GetOptions{})
-			if err != nil {
-				klog.Errorf("Unable to get configmap; invalid name/namespace for configmap or error with contacting the server, error: %s, configmap name specified in annotation %s", err.Error(), configmapName)
-				continue NEXT_DAEMONSET
-			}
-			if _, ok := watchedConfigmaps[configmapName]; !ok {
-				klog.V(3).Infof("Configmap doesn't exist in list yet, adding it %s and daemonset %s", configmapName.String(), daemonset.ObjectMeta.Name)
-				storedDaemonset := make(map[types.NamespacedName]uint)
-				storedDaemonset[types.NamespacedName{Name: daemonset.ObjectMeta.Name, Namespace: daemonset.ObjectMeta.Namespace}] = storedCounter
-				stopCh := make(chan struct{})
-				watchedConfigmaps[configmapName] = &ConfigMapper{stopCh: &stopCh, Daemonsets: storedDaemonset, Mark: storedCounter}
-				// Create a watcher informer for it
-				w.createInformer(configmapName, &stopCh)
-			} else {
-				klog.V(3).Info("Configmap already in list to watch, updating daemonset counter")
-				if watchedConfigmaps[configmapName].Daemonsets == nil {
-					storedDaemonset := make(map[types.NamespacedName]uint)
-					storedDaemonset[types.NamespacedName{Name: daemonset.ObjectMeta.Name, Namespace: daemonset.ObjectMeta.Namespace}] = storedCounter
-					watchedConfigmaps[configmapName].Daemonsets = storedDaemonset
-				} else {
-					watchedConfigmaps[configmapName].Daemonsets[types.NamespacedName{Name: daemonset.ObjectMeta.Name, Namespace: daemonset.ObjectMeta.Namespace}] = storedCounter
-				}
+		for _, configmapName := range configmapNames {
+			klog.Infof("The configmap specified by this %s %s", kind, configmapName.String())
+			if _, ok := lookup(w.configmapStores, configmapName); !ok {
+				klog.Errorf("Unable to find configmap %s specified by %s %s; it's either in a namespace that isn't allowed or doesn't exist yet", configmapName, kind, workloadName)
 			}
-			watchedConfigmaps[configmapName].Mark = storedCounter
+			refs.configmaps = append(refs.configmaps, configmapName)
 		}
+		refs.configmapKeys = parseKeys(kind, workloadName, configmapKeys, annotations)
 	}
-NEXT_STATEFULSET:
-	// Check for the configmap watched by each
-	for _, statefulset := range statefulsets.Items {
-		// If we're restricting the namespaces allowed and the namespace this statefulset is in is not allowed, we ignore it
-		if _, ok := allowedNamespaces[statefulset.ObjectMeta.Namespace]; restrictNamespaces && !ok {
-			klog.V(5).Infof("Ignoring statefulset %s/%s since it's not in an allowed namespace.", statefulset.ObjectMeta.Namespace, statefulset.ObjectMeta.Name)
-			continue NEXT_STATEFULSET
+	if value, ok := annotations[secretAnnotation]; ok {
+		klog.V(5).Infof("%s has the secret watcher annotation", kind)
+		secretNames, errs := splitNamespacedNames(value)
+		for _, err := range errs {
+			klog.Errorf("Unable to parse the %s annotation on %s %s: %s", secretAnnotation, kind, workloadName, err.Error())
 		}
-		klog.Infof("Found statefulset opting in: %s", statefulset.ObjectMeta.Name)
-		if _, ok := statefulset.ObjectMeta.Annotations[watcherAnnotation]; ok {
-			// If the statefulset has the annotation, get the namespace/name of the configmap
-			configmapName := splitNamespacedName(statefulset.ObjectMeta.Annotations[watcherAnnotation])
-			klog.V(3).Infof("The configmap specified by this statefulset %s", configmapName.String())
-			_, err := w.client.CoreV1().ConfigMaps(configmapName.Namespace).Get(configmapName.Name, metav1.GetOptions{})
-			if err != nil {
-				klog.Errorf("Unable to get configmap; invalid name/namespace for configmap or error with contacting the server, error: %s, configmap name specified: %s", err.Error(), configmapName)
-				continue NEXT_STATEFULSET
-			}
-			if _, ok := watchedConfigmaps[configmapName]; !ok {
-				klog.V(3).Infof("Configmap doesn't exist in list yet, adding it %s and statefulset %s", configmapName.String(), statefulset.ObjectMeta.Name)
-				storedStatefulset := make(map[types.NamespacedName]uint)
-				storedStatefulset[types.NamespacedName{Name: statefulset.ObjectMeta.Name, Namespace: statefulset.ObjectMeta.Namespace}] = storedCounter
-				stopCh := make(chan struct{})
-				watchedConfigmaps[configmapName] = &ConfigMapper{stopCh: &stopCh, Statefulsets: storedStatefulset, Mark: storedCounter}
-				w.createInformer(configmapName, &stopCh)
-			} else {
-				klog.V(3).Info("Configmap already in list to watch, updating counter on statefulset")
-				if watchedConfigmaps[configmapName].Statefulsets == nil {
-					storedStatefulset := make(map[types.NamespacedName]uint)
-					storedStatefulset[types.NamespacedName{Name: statefulset.ObjectMeta.Name, Namespace: statefulset.ObjectMeta.Namespace}] = storedCounter
-					watchedConfigmaps[configmapName].Statefulsets = storedStatefulset
-				} else {
-					watchedConfigmaps[configmapName].Statefulsets[types.NamespacedName{Name: statefulset.ObjectMeta.Name, Namespace: statefulset.ObjectMeta.Namespace}] = storedCounter
-				}
+		for _, secretName := range secretNames {
+			klog.Infof("The secret specified by this %s %s", kind, secretName.String())
+			if _, ok := lookup(w.secretStores, secretName); !ok {
+				klog.Errorf("Unable to find secret %s specified by %s %s; it's either in a namespace that isn't allowed or doesn't exist yet", secretName, kind, workloadName)
 			}
-			watchedConfigmaps[configmapName].Mark = storedCounter
+			refs.secrets = append(refs.secrets, secretName)
+		}
+		refs.secretKeys = parseKeys(kind, workloadName, secretKeys, annotations)
+	}
+	if value, ok := annotations[dryRunAnnotation]; ok {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			// The workload meant to opt into something, so it's left in dry run rather than restarted for real
+			klog.Errorf("Unable to parse the %s annotation on %s %s, leaving it in dry run: %s", dryRunAnnotation, kind, workloadName, err.Error())
+			dryRun = true
+		}
+		refs.dryRun = dryRun
+	}
+	if value, ok := annotations[strategyAnnotation]; ok {
+		refs.signal = parseStrategy(kind, workloadName, value, annotations)
+	}
+	if value, ok := annotations[debounceAnnotation]; ok {
+		debounce, err := time.ParseDuration(value)
+		if err != nil || debounce < 0 {
+			klog.Errorf("Unable to parse the %s annotation on %s %s as a duration: %q", debounceAnnotation, kind, workloadName, value)
+		} else {
+			refs.debounce = &debounce
+		}
+	}
+	return refs
+}
+
+// discoverReferences adds the configmaps the workload's pod spec uses to the references its annotations name, when
+// its auto annotation is set, so the workload watches the configmaps its pods actually mount and read. The
+// configmap-keys annotation applies to them as it does to the ones the configmap-resource annotation names.
+func discoverReferences(kind string, workloadName types.NamespacedName, annotations map[string]string, spec *corev1.PodSpec, refs *references) {
+	value, ok := annotations[autoAnnotation]
+	if !ok {
+		return
+	}
+	auto, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Errorf("Unable to parse the %s annotation on %s %s: %s", autoAnnotation, kind, workloadName, err.Error())
+		return
+	}
+	if !auto {
+		return
+	}
+	discovered := podConfigmaps(workloadName.Namespace, spec)
+	klog.V(2).Infof("Discovered configmaps %q in the pod spec of %s %s", discovered, kind, workloadName)
+	if _, ok := annotations[watcherAnnotation]; !ok {
+		refs.configmapKeys = parseKeys(kind, workloadName, configmapKeys, annotations)
+	}
+	refs.configmaps = appendNames(refs.configmaps, discovered)
+}
+
+// register records the references a source, the workload's annotations or a WatchPolicy, has for the workload,
+// and has the workload watch the configmaps and secrets every source references. Passing nil refs forgets the
+// source's references.
+func (w *WatcherController) register(key workload, source string, refs *references) {
+	w.watchedLock.Lock()
+	defer w.watchedLock.Unlock()
+	w.registerSource(key, source, refs)
+}
+
+// registerSource is register with watchedLock held.
+func (w *WatcherController) registerSource(key workload, source string, refs *references) {
+	sources := w.sources[key]
+	if refs == nil || (len(refs.configmaps) == 0 && len(refs.secrets) == 0) {
+		delete(sources, source)
+	} else {
+		if sources == nil {
+			sources = make(map[string]*references)
+			w.sources[key] = sources
 		}
+		sources[source] = refs
+	}
+	if len(sources) == 0 {
+		delete(w.sources, key)
 	}
+	w.watch(key, mergeReferences(sources))
+}
 
-	// Garbage collection
-	if (storedCounter % clean) == 0 {
-		klog.V(2).Info("Stored counter has reach clean count, removing stale resources.")
-		removeStale(storedCounter, watchedConfigmaps)
+// watch records the workload under each configmap and secret it references, removing it from the ones it no
+// longer references. Configmaps and secrets no workload watches anymore are dropped. Passing nil refs forgets
+// the workload. It's called with watchedLock held.
+func (w *WatcherController) watch(key workload, refs *references) {
+	old := w.watchedWorkloads[key]
+	if old != nil {
+		for _, name := range old.configmaps {
+			if mapper, ok := w.watchedConfigmaps[name]; ok {
+				mapper.untrack(key.kind, key.name)
+			}
+		}
+		for _, name := range old.secrets {
+			if mapper, ok := w.watchedSecrets[name]; ok {
+				mapper.untrack(key.kind, key.name)
+			}
+		}
+	}
 
-		if storedCounter/clean == 2 { // Only resetting once it reaches double the clean frequency allows resources that were removed on the clean frequency to get removed
-			storedCounter = 0
-			klog.V(4).Info("Completely reset counter.")
+	if refs == nil || (len(refs.configmaps) == 0 && len(refs.secrets) == 0) {
+		delete(w.watchedWorkloads, key)
+		w.cancelPending(key)
+	} else {
+		w.watchedWorkloads[key] = refs
+		for _, name := range refs.configmaps {
+			track(w.watchedConfigmaps, name, key.kind, key.name, refs.configmapKeys)
+		}
+		for _, name := range refs.secrets {
+			track(w.watchedSecrets, name, key.kind, key.name, refs.secretKeys)
 		}
 	}
-	time.Sleep(time.Duration(freq) * time.Second)
+
+	if old != nil {
+		removedTotal.WithLabelValues(configmapKind).Add(float64(removeUnwatched(old.configmaps, w.watchedConfigmaps)))
+		removedTotal.WithLabelValues(secretKind).Add(float64(removeUnwatched(old.secrets, w.watchedSecrets)))
+	}
+	w.observeWatched()
+	print(w.watchedConfigmaps)
+	print(w.watchedSecrets)
+}
+
+// track adds the workload to the configmapper of the watched resource, creating the configmapper if the
+// resource isn't being watched yet.
+func track(watched map[types.NamespacedName]*ConfigMapper, resource types.NamespacedName, kind string, workload types.NamespacedName, keys keyFilter) {
+	mapper, ok := watched[resource]
+	if !ok {
+		klog.V(3).Infof("Resource doesn't exist in list yet, adding it %s and %s %s", resource.String(), kind, workload.Name)
+		mapper = &ConfigMapper{}
+		watched[resource] = mapper
+	} else {
+		klog.V(3).Infof("Resource already in list to watch, adding %s %s", kind, workload.Name)
+	}
+	mapper.track(kind, workload, keys)
 }
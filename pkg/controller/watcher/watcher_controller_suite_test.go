@@ -94,6 +94,14 @@ var configmap = coretypes.ConfigMap{
 		Name:      "configmap",
 		Namespace: "default",
 	}}
+var secret = coretypes.Secret{
+	TypeMeta: metav1.TypeMeta{
+		Kind: "secret",
+	},
+	ObjectMeta: metav1.ObjectMeta{
+		Name:      "secret",
+		Namespace: "default",
+	}}
 
 func init() {
 	flag.Set("alsologtostderr", fmt.Sprintf("%t", true))
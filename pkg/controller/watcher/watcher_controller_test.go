@@ -16,15 +16,24 @@
 package watcher
 
 import (
+	"fmt"
+	"runtime"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	coretypes "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
 )
 
-var err error
-
 func TestReconcile(t *testing.T) {
 
 	var simpleClient kubernetes.Interface = testclient.NewSimpleClientset()
@@ -39,25 +48,303 @@ func TestReconcile(t *testing.T) {
 	// create the config map to watch annotation
 	newannot := make(map[string]string)
 	newannot[watcherAnnotation] = "default/configmap"
+	newannot[secretAnnotation] = "default/secret"
 	deployment.Annotations = newannot
 	daemonset.Annotations = newannot
 	statefulset.Annotations = newannot
 
 	simpleClient.CoreV1().ConfigMaps("default").Create(&configmap)
+	simpleClient.CoreV1().Secrets("default").Create(&secret)
 	simpleClient.AppsV1().Deployments("default").Create(&deployment)
 	simpleClient.AppsV1().DaemonSets("default").Create(&daemonset)
 	simpleClient.AppsV1().StatefulSets("default").Create(&statefulset)
-	watcher := WatcherController{
-		client: simpleClient,
-	}
-	Init(simpleClient, nil, 1, true)
-	watcher.GatherConfigMaps(1)
+	watcher := Init(simpleClient, Options{})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.Run(stopCh)
 
 	// sleep for a bit
 	time.Sleep(time.Second * 2)
-	configmap.Labels = newlbl
+	assert.Nil(t, watcher.Readyz())
+	assert.Nil(t, watcher.Healthz())
+	watcher.watchedLock.Lock()
+	assert.Contains(t, watcher.watchedConfigmaps, splitNamespacedName("default/configmap"))
+	assert.Contains(t, watcher.watchedConfigmaps[splitNamespacedName("default/configmap")].Deployments, splitNamespacedName("default/deployment"))
+	assert.Contains(t, watcher.watchedSecrets, splitNamespacedName("default/secret"))
+	watcher.watchedLock.Unlock()
+
+	configmap.Data = map[string]string{"key": "new"}
 	simpleClient.CoreV1().ConfigMaps("default").Update(&configmap)
+	secret.Data = map[string][]byte{"tls.crt": []byte("new")}
+	simpleClient.CoreV1().Secrets("default").Update(&secret)
+
+	time.Sleep(time.Second * 2)
+	restarted, err := simpleClient.AppsV1().Deployments("default").Get("deployment", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, restarted.Spec.Template.Annotations[hashAnnotation])
+
+	// Deleting the workloads stops watching the configmap and secret
+	simpleClient.AppsV1().Deployments("default").Delete("deployment", &metav1.DeleteOptions{})
+	simpleClient.AppsV1().DaemonSets("default").Delete("daemonset", &metav1.DeleteOptions{})
+	simpleClient.AppsV1().StatefulSets("default").Delete("statefulset", &metav1.DeleteOptions{})
 
 	time.Sleep(time.Second * 2)
-	watcher.GatherConfigMaps(1)
+	watcher.watchedLock.Lock()
+	assert.NotContains(t, watcher.watchedConfigmaps, splitNamespacedName("default/configmap"))
+	assert.NotContains(t, watcher.watchedSecrets, splitNamespacedName("default/secret"))
+	watcher.watchedLock.Unlock()
+}
+
+func TestControllersCoexist(t *testing.T) {
+	// Each controller only watches the configmaps of the workloads in its own cluster
+	var watchers []*WatcherController
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for _, name := range []string{"first", "second"} {
+		simpleClient := testclient.NewSimpleClientset(&v1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Labels:      map[string]string{"watcher.ibm.com/opt-in": "true"},
+				Annotations: map[string]string{watcherAnnotation: "default/" + name},
+			},
+		})
+		watcher := Init(simpleClient, Options{})
+		go watcher.Run(stopCh)
+		waitForSync(t, watcher)
+		watchers = append(watchers, watcher)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	for i, name := range []string{"first", "second"} {
+		watchers[i].watchedLock.Lock()
+		assert.Len(t, watchers[i].watchedConfigmaps, 1)
+		assert.Contains(t, watchers[i].watchedConfigmaps, splitNamespacedName("default/"+name))
+		watchers[i].watchedLock.Unlock()
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	var simpleClient kubernetes.Interface = testclient.NewSimpleClientset()
+	simpleClient.CoreV1().ConfigMaps("default").Create(&configmap)
+	watcher := Init(simpleClient, Options{ShutdownGracePeriod: 5 * time.Second})
+	// The event broadcaster is started by Init and lives as long as the controller, count it in the baseline
+	before := runtime.NumGoroutine()
+
+	stopCh := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- watcher.Run(stopCh)
+	}()
+	waitForSync(t, watcher)
+
+	// An event handler in flight holds up stopping until it's finished
+	watcher.watchedLock.Lock()
+	configmap.Data = map[string]string{"key": "stopping"}
+	simpleClient.CoreV1().ConfigMaps("default").Update(&configmap)
+	time.Sleep(100 * time.Millisecond)
+	close(stopCh)
+	select {
+	case <-stopped:
+		assert.Fail(t, "Run returned with an event handler in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	watcher.watchedLock.Unlock()
+	assert.Nil(t, <-stopped)
+
+	// Every goroutine Run started has exited, polling without wait.Poll since it starts a goroutine of its own
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "leaked %d goroutines", runtime.NumGoroutine()-before)
+}
+
+func TestRunStopsThrottled(t *testing.T) {
+	cm := &coretypes.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "throttled", Namespace: "default"}}
+	var simpleClient kubernetes.Interface = testclient.NewSimpleClientset(cm, &v1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "throttled",
+			Namespace:   "default",
+			Labels:      map[string]string{"watcher.ibm.com/opt-in": "true"},
+			Annotations: map[string]string{watcherAnnotation: "default/throttled"},
+		},
+	})
+	watcher := Init(simpleClient, Options{ShutdownGracePeriod: 5 * time.Second, RestartsPerMinute: 60})
+	stopCh := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- watcher.Run(stopCh)
+	}()
+	waitForSync(t, watcher)
+
+	// A restart queued as the watcher stops still waits on the cap, and is performed within the grace period
+	assert.True(t, watcher.throttle.Allow())
+	watcher.watchedLock.Lock()
+	cm.Data = map[string]string{"key": "stopping"}
+	simpleClient.CoreV1().ConfigMaps("default").Update(cm)
+	time.Sleep(100 * time.Millisecond)
+	close(stopCh)
+	watcher.watchedLock.Unlock()
+	assert.Nil(t, <-stopped)
+	restarted, err := simpleClient.AppsV1().Deployments("default").Get("throttled", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, restarted.Spec.Template.Annotations[hashAnnotation])
+}
+
+func TestRunGracePeriod(t *testing.T) {
+	var simpleClient kubernetes.Interface = testclient.NewSimpleClientset()
+	simpleClient.CoreV1().ConfigMaps("default").Create(&configmap)
+	watcher := Init(simpleClient, Options{ShutdownGracePeriod: 100 * time.Millisecond})
+	stopCh := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- watcher.Run(stopCh)
+	}()
+	waitForSync(t, watcher)
+
+	// An event handler that doesn't finish within the grace period is given up on
+	watcher.watchedLock.Lock()
+	configmap.Data = map[string]string{"key": "stuck"}
+	simpleClient.CoreV1().ConfigMaps("default").Update(&configmap)
+	time.Sleep(100 * time.Millisecond)
+	close(stopCh)
+	err := <-stopped
+	watcher.watchedLock.Unlock()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "grace period")
+}
+
+func TestRunCronjobs(t *testing.T) {
+	cronjob := &batchv1beta1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "cronjob",
+			Namespace:   "default",
+			Labels:      map[string]string{"watcher.ibm.com/opt-in": "true"},
+			Annotations: map[string]string{watcherAnnotation: "default/cronjob"},
+		},
+	}
+	// Cronjobs are only watched while the API server serves batch/v1beta1, which it doesn't from Kubernetes 1.25 on
+	for _, served := range []bool{false, true} {
+		simpleClient := testclient.NewSimpleClientset(cronjob)
+		if served {
+			simpleClient.Fake.Resources = []*metav1.APIResourceList{{
+				GroupVersion: "batch/v1beta1",
+				APIResources: []metav1.APIResource{{Name: "cronjobs", Namespaced: true, Kind: "CronJob"}},
+			}}
+		}
+		watcher := Init(simpleClient, Options{})
+		stopCh := make(chan struct{})
+		go watcher.Run(stopCh)
+		waitForSync(t, watcher)
+		time.Sleep(100 * time.Millisecond)
+		watcher.watchedLock.Lock()
+		assert.Equal(t, served, watcher.watchedConfigmaps[splitNamespacedName("default/cronjob")] != nil)
+		watcher.watchedLock.Unlock()
+		close(stopCh)
+	}
+}
+
+func TestRunCronjobsV1(t *testing.T) {
+	cronjob := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "CronJob",
+		"metadata": map[string]interface{}{
+			"name":        "cronjob",
+			"namespace":   "default",
+			"labels":      map[string]interface{}{"watcher.ibm.com/opt-in": "true"},
+			"annotations": map[string]interface{}{watcherAnnotation: "default/cronjob"},
+		},
+	}}
+	// batch/v1 is preferred over batch/v1beta1 when both are served, and watched through the dynamic client
+	simpleClient := testclient.NewSimpleClientset()
+	simpleClient.Fake.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "batch/v1", APIResources: []metav1.APIResource{{Name: "cronjobs", Namespaced: true, Kind: "CronJob"}}},
+		{GroupVersion: "batch/v1beta1", APIResources: []metav1.APIResource{{Name: "cronjobs", Namespaced: true, Kind: "CronJob"}}},
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(k8sruntime.NewScheme(), cronjob)
+	watcher := Init(simpleClient, Options{DynamicClient: dynamicClient})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.Run(stopCh)
+	waitForSync(t, watcher)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, watcher.cronjobsV1)
+	key := workload{kind: cronjobKind, name: splitNamespacedName("default/cronjob")}
+	watcher.watchedLock.Lock()
+	assert.Equal(t, []workload{key}, watcher.watchedConfigmaps[splitNamespacedName("default/cronjob")].workloads(nil))
+
+	// And restarted through the pod template of its job template
+	watcher.RestartAll(configmapKind, splitNamespacedName("default/cronjob"), nil)
+	hash := watcher.configHash(key)
+	watcher.watchedLock.Unlock()
+	assert.Nil(t, wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		restarted, err := dynamicClient.Resource(batchV1Cronjobs.Resource).Namespace("default").Get("cronjob", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		value, _, _ := unstructured.NestedString(restarted.Object, "spec", "jobTemplate", "spec", "template", "metadata", "annotations", hashAnnotation)
+		return value == hash, nil
+	}))
+}
+
+// waitForSync waits for Run to sync its informers.
+func waitForSync(t *testing.T, w *WatcherController) {
+	assert.Nil(t, wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		w.health.Lock()
+		defer w.health.Unlock()
+		return w.health.synced, nil
+	}))
+}
+
+// BenchmarkWatch1000ConfigMaps registers 1,000 deployments each watching its own configmap and reports
+// the number of watches opened against the API server and the heap used once they're all registered.
+func BenchmarkWatch1000ConfigMaps(b *testing.B) {
+	const count = 1000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		simpleClient := testclient.NewSimpleClientset()
+		for n := 0; n < count; n++ {
+			name := fmt.Sprintf("bench-%d", n)
+			simpleClient.CoreV1().ConfigMaps("default").Create(&coretypes.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Data:       map[string]string{"key": name},
+			})
+			simpleClient.AppsV1().Deployments("default").Create(&v1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   "default",
+					Labels:      map[string]string{"watcher.ibm.com/opt-in": "true"},
+					Annotations: map[string]string{watcherAnnotation: "default/" + name},
+				},
+			})
+		}
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+		b.StartTimer()
+
+		stopCh := make(chan struct{})
+		watcher := Init(simpleClient, Options{})
+		go watcher.Run(stopCh)
+		for registered := 0; registered < count; time.Sleep(10 * time.Millisecond) {
+			watcher.watchedLock.Lock()
+			registered = len(watcher.watchedConfigmaps)
+			watcher.watchedLock.Unlock()
+		}
+
+		b.StopTimer()
+		runtime.GC()
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		watches := 0
+		for _, action := range simpleClient.Actions() {
+			if action.GetVerb() == "watch" {
+				watches++
+			}
+		}
+		b.ReportMetric(float64(watches), "watches")
+		b.ReportMetric(float64(after.HeapAlloc)-float64(before.HeapAlloc), "heap-bytes")
+		close(stopCh)
+		b.StartTimer()
+	}
 }
@@ -0,0 +1,172 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// defaultPodTemplatePath is where the pod template is in a workload of a kind that doesn't say otherwise.
+const defaultPodTemplatePath string = "spec.template"
+
+// batchV1Cronjobs is the kind the batch/v1 cronjobs are watched and restarted as, through the dynamic client, since
+// the typed client only has batch/v1beta1 cronjobs.
+var batchV1Cronjobs = WorkloadKind{
+	Kind:            schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+	Resource:        schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"},
+	PodTemplatePath: []string{"spec", "jobTemplate", "spec", "template"},
+}
+
+// WorkloadKind is a kind of workload, beyond the built-in ones, that's watched and restarted through the dynamic
+// client, such as an Argo Rollout, an OpenShift DeploymentConfig, a Knative Service, or a custom resource. It's
+// restarted by setting the config hash annotation on its pod template.
+type WorkloadKind struct {
+	// Kind is the workload's group, version, and kind, for the events recorded against it
+	Kind schema.GroupVersionKind
+	// Resource is the workload's group, version, and resource, which are watched and patched
+	Resource schema.GroupVersionResource
+	// PodTemplatePath is the path to the workload's pod template
+	PodTemplatePath []string
+}
+
+// ParseWorkloadKind parses a workload kind written as <Kind>.<version>.<group>[/<resource>][:<pod template path>],
+// such as Rollout.v1alpha1.argoproj.io or DeploymentConfig.v1.apps.openshift.io:spec.template. The resource is
+// guessed as the lowercase plural of the kind when it's left out, and the dot-separated pod template path is
+// spec.template.
+func ParseWorkloadKind(value string) (WorkloadKind, error) {
+	kind := WorkloadKind{PodTemplatePath: strings.Split(defaultPodTemplatePath, ".")}
+	gvk := value
+	if i := strings.Index(gvk, ":"); i >= 0 {
+		kind.PodTemplatePath = strings.Split(gvk[i+1:], ".")
+		gvk = gvk[:i]
+	}
+	resource := ""
+	if i := strings.Index(gvk, "/"); i >= 0 {
+		resource = gvk[i+1:]
+		gvk = gvk[:i]
+	}
+	parts := strings.SplitN(gvk, ".", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return WorkloadKind{}, fmt.Errorf("%q isn't a workload kind of the form <Kind>.<version>.<group>[/<resource>][:<pod template path>]", value)
+	}
+	for _, field := range kind.PodTemplatePath {
+		if field == "" {
+			return WorkloadKind{}, fmt.Errorf("the pod template path of workload kind %q has an empty field", value)
+		}
+	}
+	kind.Kind = schema.GroupVersionKind{Kind: parts[0], Version: parts[1]}
+	if len(parts) == 3 {
+		kind.Kind.Group = parts[2]
+	}
+	if resource == "" {
+		kind.Resource, _ = meta.UnsafeGuessKindToResource(kind.Kind)
+	} else {
+		kind.Resource = kind.Kind.GroupVersion().WithResource(resource)
+	}
+	switch kind.name() {
+	case deploymentKind, daemonsetKind, statefulsetKind, cronjobKind, jobKind, podKind, configmapKind, secretKind:
+		return WorkloadKind{}, fmt.Errorf("workload kind %q is already watched", value)
+	}
+	return kind, nil
+}
+
+// name is what the watcher calls the workloads of this kind in its logs, metrics, and statuses, the lowercase kind
+// and its group, such as rollout.argoproj.io.
+func (k WorkloadKind) name() string {
+	name := strings.ToLower(k.Kind.Kind)
+	if k.Kind.Group != "" {
+		name += "." + k.Kind.Group
+	}
+	return name
+}
+
+// path returns the path to the fields under the workload's pod template.
+func (k WorkloadKind) path(fields ...string) []string {
+	path := make([]string, 0, len(k.PodTemplatePath)+len(fields))
+	return append(append(path, k.PodTemplatePath...), fields...)
+}
+
+// nestedPatch returns the patch setting the value under the fields. It's both a JSON merge patch and a strategic
+// merge patch.
+func nestedPatch(fields []string, value interface{}) ([]byte, error) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		value = map[string]interface{}{fields[i]: value}
+	}
+	return json.Marshal(value)
+}
+
+// dynamicKind returns the kind of the workloads of the given kind when they're watched through the dynamic client,
+// which are those of the configured workload kinds, and cronjobs when they're watched through batch/v1.
+func (w *WatcherController) dynamicKind(kind string) (WorkloadKind, bool) {
+	if kind == cronjobKind && w.cronjobsV1 {
+		return batchV1Cronjobs, true
+	}
+	workloadKind, ok := w.workloadKinds[kind]
+	return workloadKind, ok
+}
+
+// workloadPodTemplate returns the pod template of the workload, read from the pod template path of its kind when
+// it's watched through the dynamic client.
+func (w *WatcherController) workloadPodTemplate(kind string, obj interface{}) (*corev1.PodTemplateSpec, bool) {
+	workloadKind, ok := w.dynamicKind(kind)
+	if !ok {
+		return podTemplate(obj)
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, false
+	}
+	fields, found, err := unstructured.NestedMap(u.Object, workloadKind.path()...)
+	if err != nil || !found {
+		klog.V(2).Infof("No pod template at %s in %s %s/%s", strings.Join(workloadKind.PodTemplatePath, "."), kind, u.GetNamespace(), u.GetName())
+		return nil, false
+	}
+	template := &corev1.PodTemplateSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(fields, template); err != nil {
+		klog.Errorf("Unable to read the pod template of %s %s/%s: %s", kind, u.GetNamespace(), u.GetName(), err.Error())
+		return nil, false
+	}
+	return template, true
+}
+
+// restartWorkload sets the config hash annotation on the pod template of a workload watched through the dynamic
+// client. It's a JSON merge patch, since custom resources don't support strategic merge patches.
+func restartWorkload(client dynamic.Interface, kind WorkloadKind, workloadName types.NamespacedName, hash string) error {
+	workloadInterface := client.Resource(kind.Resource).Namespace(workloadName.Namespace)
+	patch, err := nestedPatch(kind.path("metadata", "annotations"), map[string]string{hashAnnotation: hash})
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		workload, err := workloadInterface.Get(workloadName.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("Error getting %s %v", kind.name(), workloadName)
+			return err
+		}
+		current, _, _ := unstructured.NestedString(workload.Object, kind.path("metadata", "annotations", hashAnnotation)...)
+		if current == hash {
+			klog.V(2).Infof("%s %s already has config hash %s", kind.Kind.Kind, workloadName.String(), hash)
+			return nil
+		}
+		klog.Infof("Restarting %s %s with config hash %s", kind.name(), workloadName.String(), hash)
+		_, err = workloadInterface.Patch(workloadName.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			klog.Errorf("Error patching %s: %v", kind.name(), err)
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+func TestParseWorkloadKind(t *testing.T) {
+	tests := []struct {
+		value    string
+		name     string
+		resource schema.GroupVersionResource
+		path     []string
+		err      bool
+	}{
+		{value: "Rollout.v1alpha1.argoproj.io", name: "rollout.argoproj.io",
+			resource: schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+			path:     []string{"spec", "template"}},
+		{value: "DeploymentConfig.v1.apps.openshift.io:spec.template", name: "deploymentconfig.apps.openshift.io",
+			resource: schema.GroupVersionResource{Group: "apps.openshift.io", Version: "v1", Resource: "deploymentconfigs"},
+			path:     []string{"spec", "template"}},
+		{value: "Service.v1.serving.knative.dev/services", name: "service.serving.knative.dev",
+			resource: schema.GroupVersionResource{Group: "serving.knative.dev", Version: "v1", Resource: "services"},
+			path:     []string{"spec", "template"}},
+		{value: "Worker.v1.example.com/workerpool:spec.pods.template", name: "worker.example.com",
+			resource: schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "workerpool"},
+			path:     []string{"spec", "pods", "template"}},
+		{value: "Rollout", err: true},
+		{value: ".v1.argoproj.io", err: true},
+		{value: "Rollout.v1alpha1.argoproj.io:spec..template", err: true},
+		{value: "Deployment.v1", err: true},
+	}
+	for _, test := range tests {
+		kind, err := ParseWorkloadKind(test.value)
+		if test.err {
+			assert.NotNil(t, err, test.value)
+			continue
+		}
+		assert.Nil(t, err, test.value)
+		assert.Equal(t, test.name, kind.name(), test.value)
+		assert.Equal(t, test.resource, kind.Resource, test.value)
+		assert.Equal(t, test.path, kind.PodTemplatePath, test.value)
+	}
+}
+
+func TestCustomWorkload(t *testing.T) {
+	kind, err := ParseWorkloadKind("Rollout.v1alpha1.argoproj.io")
+	assert.Nil(t, err)
+	rollout := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata": map[string]interface{}{
+			"name":        "app",
+			"namespace":   "default",
+			"labels":      map[string]interface{}{"watcher.ibm.com/opt-in": "true"},
+			"annotations": map[string]interface{}{autoAnnotation: "true"},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{
+						"name": "app",
+						"envFrom": []interface{}{map[string]interface{}{
+							"configMapRef": map[string]interface{}{"name": "config"},
+						}},
+					}},
+				},
+			},
+		},
+	}}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), rollout)
+	watcher := Init(testclient.NewSimpleClientset(), Options{WorkloadKinds: []WorkloadKind{kind}, DynamicClient: dynamicClient})
+	watcher.configmapStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	watcher.secretStores[""] = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	config := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "default"}, Data: map[string]string{"a": "1"}}
+	assert.Nil(t, watcher.configmapStores[""].Add(config))
+	configName := splitNamespacedName("default/config")
+	key := workload{kind: "rollout.argoproj.io", name: splitNamespacedName("default/app")}
+
+	// The configmap is discovered from the pod template
+	watcher.syncWorkload(key.kind, rollout)
+	assert.Equal(t, []workload{key}, watcher.watchedConfigmaps[configName].workloads(nil))
+
+	// The status is written on the rollout's metadata
+	watcher.startReporting()
+	synced, err := dynamicClient.Resource(kind.Resource).Namespace("default").Get("app", metav1.GetOptions{})
+	assert.Nil(t, err)
+	status := parseStatus(synced.GetAnnotations())
+	assert.NotNil(t, status)
+	assert.Equal(t, v1alpha1.WatchingState, status.State)
+
+	// The rollout is restarted through its pod template
+	watcher.watchedLock.Lock()
+	watcher.RestartAll(configmapKind, configName, nil)
+	hash := watcher.configHash(key)
+	watcher.watchedLock.Unlock()
+	drain(watcher)
+	restarted, err := dynamicClient.Resource(kind.Resource).Namespace("default").Get("app", metav1.GetOptions{})
+	assert.Nil(t, err)
+	value, _, _ := unstructured.NestedString(restarted.Object, "spec", "template", "metadata", "annotations", hashAnnotation)
+	assert.Equal(t, hash, value)
+	assert.Equal(t, uint64(0), watcher.Failures())
+
+	// Once it stops opting in, it's forgotten
+	watcher.workloadHandler(key.kind).OnDelete(restarted)
+	assert.Empty(t, watcher.watchedConfigmaps)
+}
+
+func TestRunWorkloadKinds(t *testing.T) {
+	served, err := ParseWorkloadKind("Rollout.v1alpha1.argoproj.io")
+	assert.Nil(t, err)
+	missing, err := ParseWorkloadKind("Widget.v1.example.com")
+	assert.Nil(t, err)
+	rollout := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata": map[string]interface{}{
+			"name":        "app",
+			"namespace":   "default",
+			"labels":      map[string]interface{}{"watcher.ibm.com/opt-in": "true"},
+			"annotations": map[string]interface{}{watcherAnnotation: "default/config"},
+		},
+	}}
+	simpleClient := testclient.NewSimpleClientset()
+	simpleClient.Fake.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "argoproj.io/v1alpha1",
+		APIResources: []metav1.APIResource{{Name: "rollouts", Namespaced: true, Kind: "Rollout"}},
+	}}
+	watcher := Init(simpleClient, Options{
+		WorkloadKinds: []WorkloadKind{served, missing},
+		DynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), rollout),
+	})
+
+	// The kind that isn't served is skipped rather than keeping the informers from syncing
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go watcher.Run(stopCh)
+	waitForSync(t, watcher)
+	time.Sleep(100 * time.Millisecond)
+	watcher.watchedLock.Lock()
+	defer watcher.watchedLock.Unlock()
+	assert.Equal(t, []workload{{kind: "rollout.argoproj.io", name: splitNamespacedName("default/app")}},
+		watcher.watchedConfigmaps[splitNamespacedName("default/config")].workloads(nil))
+}
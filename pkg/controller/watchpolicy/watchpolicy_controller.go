@@ -0,0 +1,195 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watchpolicy
+
+import (
+	"context"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+// Registry keeps the workloads each WatchPolicy selects watching its configmaps and secrets. The configmap watcher
+// implements it. SetPolicy returns the state of the policy and a message explaining it, or an empty state while it
+// can't tell yet.
+type Registry interface {
+	SetPolicy(policy *v1alpha1.WatchPolicy, workloads []runtime.Object) (v1alpha1.WatchState, string)
+	RemovePolicy(policy types.NamespacedName)
+}
+
+// statusRequeuePeriod is how often a policy that isn't watching everything it references is reconciled again, since
+// the configmaps and secrets being created doesn't reconcile it.
+const statusRequeuePeriod time.Duration = 30 * time.Second
+
+// Add creates a new WatchPolicy Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager, registry Registry) error {
+	return add(mgr, newReconciler(mgr, registry))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, registry Registry) *ReconcileWatchPolicy {
+	return &ReconcileWatchPolicy{client: mgr.GetClient(), registry: registry}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r *ReconcileWatchPolicy) error {
+	c, err := controller.New("watchpolicy-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to the WatchPolicies
+	err = c.Watch(&source.Kind{Type: &v1alpha1.WatchPolicy{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// Watch for workloads being created, deleted, or relabeled, which may change what the policies in their namespace
+	// select
+	for _, workload := range []runtime.Object{&appsv1.Deployment{}, &appsv1.DaemonSet{}, &appsv1.StatefulSet{}} {
+		err = c.Watch(&source.Kind{Type: workload}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.policiesInNamespace),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blank assignment to verify that ReconcileWatchPolicy implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileWatchPolicy{}
+
+// ReconcileWatchPolicy reconciles a WatchPolicy object
+type ReconcileWatchPolicy struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client   client.Client
+	registry Registry
+}
+
+// Reconcile has the workloads a WatchPolicy selects watch its configmaps and secrets, and the workloads it no longer
+// selects stop watching them, then writes the policy's status.
+func (r *ReconcileWatchPolicy) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	klog.V(2).Infof("Reconciling WatchPolicy %s", request.NamespacedName.String())
+
+	policy := &v1alpha1.WatchPolicy{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, policy)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// The policy was deleted, so nothing it selected watches its configmaps and secrets anymore
+			r.registry.RemovePolicy(request.NamespacedName)
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.Selector)
+	if err != nil {
+		// Requeuing won't fix the selector, the policy is reconciled again once it's updated
+		klog.Errorf("Unable to parse the selector of WatchPolicy %s: %s", request.NamespacedName.String(), err.Error())
+		state, message := r.registry.SetPolicy(policy, nil)
+		return r.updateStatus(policy, nil, state, message)
+	}
+	opts := []client.ListOption{client.InNamespace(policy.Namespace), client.MatchingLabelsSelector{Selector: selector}}
+
+	var workloads []runtime.Object
+	var names []string
+	deployments := &appsv1.DeploymentList{}
+	if err := r.client.List(context.TODO(), deployments, opts...); err != nil {
+		return reconcile.Result{}, err
+	}
+	for i := range deployments.Items {
+		workloads = append(workloads, &deployments.Items[i])
+		names = append(names, "deployment/"+deployments.Items[i].Name)
+	}
+	daemonsets := &appsv1.DaemonSetList{}
+	if err := r.client.List(context.TODO(), daemonsets, opts...); err != nil {
+		return reconcile.Result{}, err
+	}
+	for i := range daemonsets.Items {
+		workloads = append(workloads, &daemonsets.Items[i])
+		names = append(names, "daemonset/"+daemonsets.Items[i].Name)
+	}
+	statefulsets := &appsv1.StatefulSetList{}
+	if err := r.client.List(context.TODO(), statefulsets, opts...); err != nil {
+		return reconcile.Result{}, err
+	}
+	for i := range statefulsets.Items {
+		workloads = append(workloads, &statefulsets.Items[i])
+		names = append(names, "statefulset/"+statefulsets.Items[i].Name)
+	}
+
+	state, message := r.registry.SetPolicy(policy, workloads)
+	return r.updateStatus(policy, names, state, message)
+}
+
+// updateStatus writes the workloads the policy selects and its Watching condition, if they changed. The policy is
+// requeued while it isn't watching everything it references, and left alone while the state is unknown.
+func (r *ReconcileWatchPolicy) updateStatus(policy *v1alpha1.WatchPolicy, workloads []string, state v1alpha1.WatchState, message string) (reconcile.Result, error) {
+	result := reconcile.Result{}
+	if state != v1alpha1.WatchingState {
+		result.RequeueAfter = statusRequeuePeriod
+	}
+	if state == "" {
+		return result, nil
+	}
+
+	condition := v1alpha1.WatchPolicyCondition{
+		Type:               v1alpha1.WatchingCondition,
+		Status:             corev1.ConditionFalse,
+		Reason:             state,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	}
+	if state == v1alpha1.WatchingState {
+		condition.Status = corev1.ConditionTrue
+	}
+	for _, old := range policy.Status.Conditions {
+		if old.Type == condition.Type && old.Status == condition.Status {
+			condition.LastTransitionTime = old.LastTransitionTime
+		}
+	}
+	status := v1alpha1.WatchPolicyStatus{Workloads: workloads, Conditions: []v1alpha1.WatchPolicyCondition{condition}}
+	if equality.Semantic.DeepEqual(policy.Status, status) {
+		return result, nil
+	}
+
+	klog.V(2).Infof("Updating the status of WatchPolicy %s/%s: %s", policy.Namespace, policy.Name, state)
+	policy.Status = status
+	if err := r.client.Status().Update(context.TODO(), policy); err != nil {
+		return reconcile.Result{}, err
+	}
+	return result, nil
+}
+
+// policiesInNamespace maps a workload to the WatchPolicies in its namespace, any of which may select it.
+func (r *ReconcileWatchPolicy) policiesInNamespace(obj handler.MapObject) []reconcile.Request {
+	policies := &v1alpha1.WatchPolicyList{}
+	if err := r.client.List(context.TODO(), policies, client.InNamespace(obj.Meta.GetNamespace())); err != nil {
+		klog.Errorf("Unable to list the WatchPolicies in namespace %s: %s", obj.Meta.GetNamespace(), err.Error())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(policies.Items))
+	for _, policy := range policies.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}})
+	}
+	return requests
+}
@@ -0,0 +1,114 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package watchpolicy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis"
+	"github.com/open-cluster-management/configmap-watcher/pkg/apis/watcher/v1alpha1"
+)
+
+// fakeRegistry records the workloads each policy was last set with, and reports state for every policy.
+type fakeRegistry struct {
+	policies map[types.NamespacedName][]string
+	state    v1alpha1.WatchState
+}
+
+func (r *fakeRegistry) SetPolicy(policy *v1alpha1.WatchPolicy, workloads []runtime.Object) (v1alpha1.WatchState, string) {
+	names := []string{}
+	for _, workload := range workloads {
+		names = append(names, workload.(metav1.Object).GetName())
+	}
+	r.policies[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}] = names
+	return r.state, "message"
+}
+
+func (r *fakeRegistry) RemovePolicy(policy types.NamespacedName) {
+	delete(r.policies, policy)
+}
+
+func TestReconcile(t *testing.T) {
+	s := runtime.NewScheme()
+	assert.Nil(t, scheme.AddToScheme(s))
+	assert.Nil(t, apis.AddToScheme(s))
+
+	selected := map[string]string{"app": "web"}
+	policy := &v1alpha1.WatchPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: "default"},
+		Spec: v1alpha1.WatchPolicySpec{
+			Selector:   metav1.LabelSelector{MatchLabels: selected},
+			ConfigMaps: []string{"config"},
+		},
+	}
+	client := fake.NewFakeClientWithScheme(s,
+		policy,
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: selected}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "web-cache", Namespace: "default", Labels: selected}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "other", Labels: selected}},
+	)
+	registry := &fakeRegistry{policies: map[types.NamespacedName][]string{}}
+	r := &ReconcileWatchPolicy{client: client, registry: registry}
+	name := types.NamespacedName{Namespace: "default", Name: "policy"}
+
+	// The policy selects the labeled workloads in its namespace. Its status isn't written while the state is unknown.
+	result, err := r.Reconcile(reconcile.Request{NamespacedName: name})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"web", "web-cache"}, registry.policies[name])
+	assert.Equal(t, statusRequeuePeriod, result.RequeueAfter)
+	assert.Nil(t, client.Get(context.TODO(), name, policy))
+	assert.Empty(t, policy.Status.Conditions)
+
+	// A missing configmap is reported, and the policy requeued until it's found
+	registry.state = v1alpha1.ConfigMapNotFoundState
+	result, err = r.Reconcile(reconcile.Request{NamespacedName: name})
+	assert.Nil(t, err)
+	assert.Equal(t, statusRequeuePeriod, result.RequeueAfter)
+	assert.Nil(t, client.Get(context.TODO(), name, policy))
+	assert.Equal(t, []string{"deployment/web", "statefulset/web-cache"}, policy.Status.Workloads)
+	assert.Len(t, policy.Status.Conditions, 1)
+	condition := policy.Status.Conditions[0]
+	assert.Equal(t, v1alpha1.WatchingCondition, condition.Type)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, v1alpha1.ConfigMapNotFoundState, condition.Reason)
+	assert.Equal(t, "message", condition.Message)
+
+	registry.state = v1alpha1.WatchingState
+	result, err = r.Reconcile(reconcile.Request{NamespacedName: name})
+	assert.Nil(t, err)
+	assert.Zero(t, result.RequeueAfter)
+	assert.Nil(t, client.Get(context.TODO(), name, policy))
+	assert.Equal(t, corev1.ConditionTrue, policy.Status.Conditions[0].Status)
+	assert.Equal(t, v1alpha1.WatchingState, policy.Status.Conditions[0].Reason)
+
+	// A workload event reconciles the policies in its namespace
+	requests := r.policiesInNamespace(handler.MapObject{Meta: &metav1.ObjectMeta{Name: "agent", Namespace: "default"}})
+	assert.Equal(t, []reconcile.Request{{NamespacedName: name}}, requests)
+	assert.Empty(t, r.policiesInNamespace(handler.MapObject{Meta: &metav1.ObjectMeta{Name: "web", Namespace: "other"}}))
+
+	// A selector that doesn't parse selects nothing
+	policy.Spec.Selector = metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Bogus"}}}
+	assert.Nil(t, client.Update(context.TODO(), policy))
+	_, err = r.Reconcile(reconcile.Request{NamespacedName: name})
+	assert.Nil(t, err)
+	assert.Empty(t, registry.policies[name])
+
+	// A deleted policy is removed
+	assert.Nil(t, client.Delete(context.TODO(), policy))
+	_, err = r.Reconcile(reconcile.Request{NamespacedName: name})
+	assert.Nil(t, err)
+	assert.NotContains(t, registry.policies, name)
+}